@@ -2,13 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io/ioutil"
+	"mime"
 	"net/http"
-	"net/url"
-	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
@@ -32,7 +33,7 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if IsUserExists(username) {
+	if IsUserExists(r.Context(), username) {
 		fmt.Fprint(w, "user already exists")
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -40,14 +41,14 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 
 	passwordHash, err := sessionManager.EncryptPassword(password)
 	if err != nil {
-		log.Println("could not encrypt password", err)
+		loggerFrom(r.Context()).Error("could not encrypt password", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	err = db.InsertUser(username, fullName, passwordHash)
+	err = db.InsertUser(r.Context(), username, fullName, passwordHash)
 	if err != nil {
-		log.Println("could not add new user:", err)
+		loggerFrom(r.Context()).Error("could not add new user", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -62,30 +63,57 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	username := strings.TrimSpace(r.FormValue("username"))
 	password := r.FormValue("password")
 	if len(username) == 0 || len(password) == 0 {
+		logins.WithLabelValues("missing_credentials").Inc()
 		fmt.Fprint(w, "credentials are not provided")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	user, err := db.GetUser(username)
+	user, err := db.GetUser(r.Context(), username)
 	if err != nil {
-		log.Println("could not get user:", err)
+		logins.WithLabelValues("unknown_user").Inc()
+		loggerFrom(r.Context()).Warn("could not get user", "error", err)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
-		log.Println("could not compare hashed password:", err)
+		logins.WithLabelValues("wrong_password").Inc()
+		loggerFrom(r.Context()).Warn("could not compare hashed password", "error", err)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	_, err = sessionManager.SessionStart(w, r, user)
+	openSession(w, r, user)
+}
+
+// openSession logs the user in after their credentials were checked: it
+// starts a cookie session and redirects to the main page, or in the jwt
+// session mode answers with tokens.
+func openSession(w http.ResponseWriter, r *http.Request, user User) {
+	if config.Session.Mode == sessionModeJWT {
+		tokens, err := IssueTokens(r, user)
+		if err != nil {
+			logins.WithLabelValues("error").Inc()
+			loggerFrom(r.Context()).Error("could not issue tokens", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		logins.WithLabelValues("success").Inc()
+
+		w.Header().Set("Cache-Control", "no-store")
+		writeResponse(w, r, http.StatusOK, tokensV1(tokens))
+		return
+	}
+
+	_, err := sessionManager.SessionStart(w, r, user)
 	if err != nil {
-		log.Println("could not start session:", err)
+		logins.WithLabelValues("error").Inc()
+		loggerFrom(r.Context()).Error("could not start session", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	logins.WithLabelValues("success").Inc()
 
 	http.Redirect(w, r, "/", 302)
 }
@@ -96,15 +124,142 @@ func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sid, err := r.Cookie(os.Getenv("COOKIE_SID"))
+	if config.Session.Mode == sessionModeJWT {
+		refreshToken, err := refreshTokenFromRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(refreshToken) != 0 {
+			if err := RevokeTokens(r.Context(), refreshToken); err != nil && err != ErrRefreshTokenNotValid {
+				loggerFrom(r.Context()).Error("could not revoke tokens", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+
+	sessionKey, err := sessionManager.getSessionID(r)
 	if err != nil {
-		log.Println("could not get session key from cookie", err)
+		loggerFrom(r.Context()).Warn("could not get session key from cookie", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	sessionKey, _ := url.QueryUnescape(sid.Value)
-	sessionManager.DestroySession(sessionKey)
+	if err := sessionManager.DestroySession(r.Context(), sessionKey); err != nil {
+		loggerFrom(r.Context()).Error("could not destroy session", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	sessionManager.clearCookie(w)
+}
+
+// OIDCLoginHandler sends the user to log in at the OpenID Connect
+// provider, which redirects them back to OIDCCallbackHandler.
+func OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if oidcClient == nil {
+		http.Error(w, "login with OIDC is not enabled", http.StatusNotFound)
+		return
+	}
+
+	url, login, err := oidcClient.AuthCodeURL(r.Context())
+	if err != nil {
+		loggerFrom(r.Context()).Error("could not start oidc login", "error", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if err := oidcClient.setLoginCookie(w, login); err != nil {
+		loggerFrom(r.Context()).Error("could not start oidc login", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// OIDCCallbackHandler redeems the code of the provider and opens a session
+// of the user linked to the identity, like LoginHandler.
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if oidcClient == nil {
+		http.Error(w, "login with OIDC is not enabled", http.StatusNotFound)
+		return
+	}
+
+	login, err := oidcClient.loginFromCookie(w, r)
+	if err != nil {
+		logins.WithLabelValues("oidc_invalid_state").Inc()
+		loggerFrom(r.Context()).Warn("invalid oidc callback", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if providerError := r.FormValue("error"); len(providerError) != 0 {
+		logins.WithLabelValues("oidc_denied").Inc()
+		loggerFrom(r.Context()).Warn("oidc login failed at provider", "error", providerError, "description", r.FormValue("error_description"))
+		http.Error(w, "login failed at the identity provider: "+providerError, http.StatusUnauthorized)
+		return
+	}
+
+	user, err := oidcClient.Exchange(r.Context(), login, r.FormValue("code"))
+	if err == ErrUserDisabled {
+		logins.WithLabelValues("oidc_disabled_user").Inc()
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		logins.WithLabelValues("oidc_error").Inc()
+		loggerFrom(r.Context()).Warn("could not complete oidc login", "error", err)
+		http.Error(w, "could not complete the login", http.StatusUnauthorized)
+		return
+	}
+
+	openSession(w, r, user)
+}
+
+// TokenRefreshHandler exchanges a refresh token for new tokens in the jwt
+// session mode. Each refresh token can be used once.
+func TokenRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if config.Session.Mode != sessionModeJWT {
+		http.Error(w, "token sessions are not enabled", http.StatusNotFound)
+		return
+	}
+
+	refreshToken, err := refreshTokenFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(refreshToken) == 0 {
+		http.Error(w, "refresh_token is not set", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := RefreshTokens(r.Context(), refreshToken)
+	if err == ErrRefreshTokenNotValid || err == ErrRefreshTokenReused {
+		loggerFrom(r.Context()).Warn("could not refresh tokens", "error", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		loggerFrom(r.Context()).Error("could not refresh tokens", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeResponse(w, r, http.StatusOK, tokensV1(tokens))
 }
 
 func RecipesHandler(w http.ResponseWriter, r *http.Request) {
@@ -142,7 +297,7 @@ func ListHandler(w http.ResponseWriter, r *http.Request) {
 	if len(itemsVal) != 0 {
 		items, err = strconv.ParseInt(itemsVal, 10, 32)
 		if err != nil {
-			log.Println("items number is not valid", err)
+			loggerFrom(r.Context()).Warn("items number is not valid", "error", err)
 			items = 0
 		}
 	}
@@ -151,68 +306,36 @@ func ListHandler(w http.ResponseWriter, r *http.Request) {
 	if len(pageVal) != 0 {
 		page, err = strconv.ParseInt(pageVal, 10, 32)
 		if err != nil {
-			log.Println("page number is not valid", err)
+			loggerFrom(r.Context()).Warn("page number is not valid", "error", err)
 			page = 0
 		}
 	}
 
-	recipes, err := db.GetRecipes(0, int(items), int(page))
+	recipes, err := db.GetRecipes(r.Context(), 0, int(items), int(page))
 	if err != nil {
-		log.Println("could not list recipes:", err)
+		loggerFrom(r.Context()).Error("could not list recipes", "error", err)
 		fmt.Fprint(w, "could not list recipes")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	b, err := json.Marshal(recipes)
-	if err != nil {
-		log.Println("could not parse JSON:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	w.Header().Set("Content-Type", "text/json")
-	w.Write(b)
+	writeResponse(w, r, http.StatusOK, recipesV1(recipes))
 }
 
 func CreateHandler(w http.ResponseWriter, r *http.Request) {
 	if !isAuthorized(w, r) {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
-	name := strings.TrimSpace(r.FormValue("name"))
-	if len(name) == 0 {
-		fmt.Fprint(w, "name is not set")
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	prepTime, err := strconv.ParseInt(strings.TrimSpace(r.FormValue("prep_time")), 10, 32)
-	if err != nil || prepTime < 0 {
-		log.Println("could not parse prep_time:", err)
-		fmt.Fprint(w, "prep_time is not valid")
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	difficulty, err := strconv.ParseInt(strings.TrimSpace(r.FormValue("difficulty")), 10, 8)
-	if err != nil || difficulty < 1 || difficulty > 3 {
-		log.Println("could not parse difficulty:", err)
-		fmt.Fprint(w, "difficulty is not valid")
-		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	vegeterian, err := strconv.ParseBool(strings.TrimSpace(r.FormValue("vegeterian")))
+	fields, err := recipeFieldsFromRequest(r)
 	if err != nil {
-		log.Println("could not parse vegeterian:", err)
-		fmt.Fprint(w, "vegeterian is not valid")
-		w.WriteHeader(http.StatusBadRequest)
+		loggerFrom(r.Context()).Warn("invalid recipe", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if err := CreateRecipe(name, int(prepTime), int8(difficulty), vegeterian); err != nil {
-		log.Println("cannot add new recipe:", err)
+	if err := CreateRecipe(r.Context(), fields.Name, fields.PrepTime, fields.Difficulty, fields.Vegeterian); err != nil {
+		loggerFrom(r.Context()).Error("cannot add new recipe", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -229,130 +352,299 @@ func GetHandler(w http.ResponseWriter, r *http.Request) {
 
 	recipeID, err := strconv.ParseInt(id, 10, 32)
 	if err != nil {
-		log.Println("could not parse recipeID", err)
+		loggerFrom(r.Context()).Warn("could not parse recipeID", "error", err)
 		fmt.Fprintf(w, "ERROR: INVALID ID; %s", id)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	recipes, err := db.GetRecipes(recipeID, 0, 0)
+	recipes, err := db.GetRecipes(r.Context(), recipeID, 0, 0)
 	if err != nil {
-		log.Println("could not get recipe(s):", err)
+		loggerFrom(r.Context()).Error("could not get recipe(s)", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	if len(recipes) == 0 {
-		log.Println("no recipe found")
+		http.Error(w, "recipe id provided does not exist", http.StatusNotFound)
 		return
 	}
 
-	b, err := json.Marshal(recipes)
-	if err != nil {
-		log.Printf("could not convert to JSON: %s\r\n", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	format := r.FormValue("format")
+	if format != "" && format != "json" && format != "jsonld" {
+		http.Error(w, "format must be json or jsonld", http.StatusBadRequest)
+		return
+	}
+
+	// The representation is chosen before the conditional check, as each one
+	// has its own entity tag. An explicit format wins over the Accept header.
+	w.Header().Add("Vary", "Accept")
+	jsonld := format == "jsonld" || (format == "" && prefersMediaType(r, jsonldMediaType))
+	encoder, ok := responseEncoders[0], true
+	if !jsonld && format != "json" {
+		encoder, ok = negotiateEncoder(r)
+	}
+	if !ok {
+		writeNotAcceptable(w)
+		return
+	}
+	mediaType := encoder.mediaType
+	if jsonld {
+		mediaType = jsonldMediaType
+	}
+
+	etag := recipeETag(recipes[0].Version, mediaType)
+	w.Header().Set("ETag", etag)
+	if notModified(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if jsonld {
+		b, err := json.Marshal(recipeJSONLD(recipes[0]))
+		if err != nil {
+			loggerFrom(r.Context()).Error("could not convert to JSON-LD", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", jsonldMediaType)
+		w.Write(b)
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/json")
-	w.Write(b)
+	writeEncoded(w, r, http.StatusOK, encoder, recipesV1(recipes))
 }
 
+// UpdateHandler replaces a recipe on PUT, taking every field as form values
+// or a JSON object. On PATCH it applies a JSON Merge Patch or JSON Patch
+// body, or updates only the given form values.
 func UpdateHandler(w http.ResponseWriter, r *http.Request) {
 	if !isAuthorized(w, r) {
-		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !checkIfMatch(w, r) {
 		return
 	}
 
 	vars := mux.Vars(r)
 	id := vars["id"]
 	if len(id) == 0 {
-		fmt.Fprint(w, "id is not set")
-		w.WriteHeader(http.StatusBadRequest)
+		http.Error(w, "id is not set", http.StatusBadRequest)
 		return
 	}
 
 	recipeID, err := strconv.ParseInt(id, 10, 64)
 	if err != nil {
-		log.Println("could not parse recipeID:", err)
-		fmt.Fprintf(w, "ERROR: INVALID ID; %s", id)
-		w.WriteHeader(http.StatusBadRequest)
+		loggerFrom(r.Context()).Warn("could not parse recipeID", "error", err)
+		http.Error(w, fmt.Sprintf("ERROR: INVALID ID; %s", id), http.StatusBadRequest)
+		return
+	}
+
+	match := ifMatchVersions(r)
+	if r.Method == "PUT" {
+		fields, err := recipeFieldsFromRequest(r)
+		if err == nil {
+			err = ReplaceRecipe(r.Context(), recipeID, fields, match)
+		}
+		writeUpdateError(w, r, err)
 		return
 	}
 
-	// Check if recipe ID provided exists
-	recipes, err := db.GetRecipes(recipeID, 0, 0)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case mergePatchMediaType, jsonPatchMediaType:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "could not read body", http.StatusBadRequest)
+			return
+		}
+
+		var patch DocumentPatch
+		if mediaType == mergePatchMediaType {
+			patch, err = ParseMergePatch(body)
+		} else {
+			patch, err = ParseJSONPatch(body)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeUpdateError(w, r, PatchRecipe(r.Context(), recipeID, patch, match))
+	case "", "application/x-www-form-urlencoded", "multipart/form-data":
+		updateMap := make(map[string]string)
+		for _, col := range []string{"name", "prep_time", "difficulty", "vegetarian", "vegeterian"} {
+			value := strings.TrimSpace(r.FormValue(col))
+			if len(value) != 0 {
+				updateMap[col] = value
+			}
+		}
+
+		if len(updateMap) == 0 {
+			http.Error(w, "no update params was provided", http.StatusBadRequest)
+			return
+		}
+
+		writeUpdateError(w, r, UpdateRecipe(r.Context(), recipeID, updateMap, match))
+	default:
+		w.Header().Set("Accept-Patch", mergePatchMediaType+", "+jsonPatchMediaType)
+		http.Error(w, fmt.Sprintf("unsupported patch content type %s", mediaType), http.StatusUnsupportedMediaType)
+	}
+}
+
+// writeUpdateError answers with the status matching an error returned by
+// a recipe update, if any.
+func writeUpdateError(w http.ResponseWriter, r *http.Request, err error) {
+	var validationErr *ValidationError
+	var patchErr *PatchError
+	switch {
+	case err == nil:
+	case errors.As(err, &validationErr):
+		loggerFrom(r.Context()).Warn("invalid recipe", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.As(err, &patchErr):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case err == ErrPatchTestFailed:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err == ErrRecipeNotFound:
+		http.Error(w, "recipe id provided does not exist", http.StatusNotFound)
+	case err == ErrVersionMismatch:
+		http.Error(w, "recipe was modified, get it again and retry", http.StatusPreconditionFailed)
+	default:
+		loggerFrom(r.Context()).Error("could not update recipe", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func RevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !isAuthorized(w, r) {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	recipeID, err := strconv.ParseInt(id, 10, 32)
 	if err != nil {
-		log.Println("could not update recipe", err)
-		fmt.Fprintf(w, "could not update recipe")
+		http.Error(w, fmt.Sprintf("ERROR: INVALID ID; %s", id), http.StatusBadRequest)
+		return
+	}
+
+	revisions, err := db.GetRecipeRevisions(r.Context(), recipeID)
+	if err == ErrRecipeNotFound {
+		http.Error(w, "recipe id provided does not exist", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		loggerFrom(r.Context()).Error("could not list recipe revisions", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if len(recipes) == 0 {
-		fmt.Fprintf(w, "recipe id provided does not exist")
-		w.WriteHeader(http.StatusBadRequest)
+
+	writeResponse(w, r, http.StatusOK, recipeRevisionsV1(revisions))
+}
+
+func RevisionsDiffHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
-	updateMap := make(map[string]string)
-	name := strings.TrimSpace(r.FormValue("name"))
-	if len(name) != 0 {
-		updateMap["name"] = name
+	if !isAuthorized(w, r) {
+		return
 	}
 
-	prepTime := strings.TrimSpace(r.FormValue("prep_time"))
-	if len(prepTime) != 0 {
-		_, err := strconv.ParseInt(prepTime, 10, 64)
-		if err != nil {
-			fmt.Fprint(w, "prep_time is not valid")
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
+	id := mux.Vars(r)["id"]
+	recipeID, err := strconv.ParseInt(id, 10, 32)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("ERROR: INVALID ID; %s", id), http.StatusBadRequest)
+		return
+	}
 
-		updateMap["prep_time"] = prepTime
+	from, err := strconv.Atoi(strings.TrimSpace(r.FormValue("from")))
+	if err != nil || from < 0 {
+		http.Error(w, "from is not valid", http.StatusBadRequest)
+		return
+	}
+	to, err := strconv.Atoi(strings.TrimSpace(r.FormValue("to")))
+	if err != nil || to < 0 {
+		http.Error(w, "to is not valid", http.StatusBadRequest)
+		return
 	}
 
-	difficulty := strings.TrimSpace(r.FormValue("difficulty"))
-	if len(difficulty) != 0 {
-		_, err := strconv.ParseInt(difficulty, 10, 64)
-		if err != nil {
-			fmt.Fprint(w, "difficulty is not valid")
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
+	changes, err := DiffRecipeRevisions(r.Context(), recipeID, from, to)
+	if err == ErrRecipeNotFound {
+		http.Error(w, "recipe id provided does not exist", http.StatusNotFound)
+		return
+	}
+	if err == ErrRevisionNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		loggerFrom(r.Context()).Error("could not diff recipe revisions", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-		updateMap["difficulty"] = difficulty
+	writeResponse(w, r, http.StatusOK, fieldChangesV1(changes))
+}
+
+func RevertHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
 	}
 
-	vegeterian := strings.TrimSpace(r.FormValue("vegeterian"))
-	var vegBool bool
-	if len(vegeterian) != 0 {
-		vegBool, err = strconv.ParseBool(vegeterian)
-		if err != nil {
-			fmt.Fprint(w, "vegeterian is not valid")
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
+	if !isAuthorized(w, r) {
+		return
+	}
 
-		updateMap["vegeterian"] = strconv.FormatBool(vegBool)
+	if !checkIfMatch(w, r) {
+		return
 	}
 
-	if len(updateMap) == 0 {
-		fmt.Fprint(w, "no update params was provided")
-		w.WriteHeader(http.StatusBadRequest)
+	vars := mux.Vars(r)
+	recipeID, err := strconv.ParseInt(vars["id"], 10, 32)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("ERROR: INVALID ID; %s", vars["id"]), http.StatusBadRequest)
+		return
+	}
+	revision, err := strconv.Atoi(vars["revision"])
+	if err != nil || revision < 0 {
+		http.Error(w, fmt.Sprintf("ERROR: INVALID REVISION; %s", vars["revision"]), http.StatusBadRequest)
 		return
 	}
 
-	err = UpdateRecipe(recipeID, updateMap)
+	reverted, err := RevertRecipe(r.Context(), recipeID, revision, ifMatchVersions(r))
+	if err == ErrRevisionNotFound || err == ErrRecipeNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err == ErrVersionMismatch {
+		http.Error(w, "recipe was modified, get it again and retry", http.StatusPreconditionFailed)
+		return
+	}
 	if err != nil {
-		log.Println("could not update recipe:", err)
+		loggerFrom(r.Context()).Error("could not revert recipe", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+
+	writeResponse(w, r, http.StatusOK, recipeRevisionV1(reverted))
 }
 
 func DeleteHandler(w http.ResponseWriter, r *http.Request) {
-	if !isAuthorized(w, r) {
-		w.WriteHeader(http.StatusUnauthorized)
+	session, ok := authorizedSession(w, r)
+	if !ok {
+		return
+	}
+
+	if !checkIfMatch(w, r) {
 		return
 	}
 
@@ -371,13 +663,96 @@ func DeleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = DeleteRecipe(recipeID)
+	permanent := false
+	permanentVal := strings.TrimSpace(r.FormValue("permanent"))
+	if len(permanentVal) != 0 {
+		permanent, err = strconv.ParseBool(permanentVal)
+		if err != nil {
+			http.Error(w, "permanent is not valid", http.StatusBadRequest)
+			return
+		}
+	}
+	// Deleting for good skips the trash, which only admins manage
+	if permanent && !session.User.IsAdmin {
+		http.Error(w, "only admins can delete recipes permanently", http.StatusForbidden)
+		return
+	}
+
+	err = DeleteRecipe(r.Context(), recipeID, permanent, ifMatchVersions(r))
+	if err == ErrRecipeNotFound {
+		http.Error(w, "recipe id provided does not exist", http.StatusNotFound)
+		return
+	}
+	if err == ErrVersionMismatch {
+		http.Error(w, "recipe was modified, get it again and retry", http.StatusPreconditionFailed)
+		return
+	}
 	if err != nil {
+		loggerFrom(r.Context()).Error("could not delete recipe", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
 
+func RestoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, ok := authorizedSession(w, r)
+	if !ok {
+		return
+	}
+	if !session.User.IsAdmin {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	recipeID, err := strconv.ParseInt(id, 10, 32)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("ERROR: INVALID ID; %s", id), http.StatusBadRequest)
+		return
+	}
+
+	err = RestoreRecipe(r.Context(), recipeID)
+	if err == ErrRecipeNotFound {
+		http.Error(w, "recipe id provided is not in the trash", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		loggerFrom(r.Context()).Error("could not restore recipe", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func TrashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, ok := authorizedSession(w, r)
+	if !ok {
+		return
+	}
+	if !session.User.IsAdmin {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	recipes, err := db.GetDeletedRecipes(r.Context())
+	if err != nil {
+		loggerFrom(r.Context()).Error("could not list deleted recipes", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, deletedRecipesV1(recipes))
+}
+
 func RateHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "PUT" && r.Method != "PATCH" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -407,9 +782,13 @@ func RateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = RateRecipe(recipeID, int8(rating))
+	err = RateRecipe(r.Context(), recipeID, int8(rating))
+	if err == ErrRecipeNotFound {
+		http.Error(w, "recipe id provided does not exist", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		log.Println("could not rate recipe:", err)
+		loggerFrom(r.Context()).Error("could not rate recipe", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -423,33 +802,346 @@ func SearchHandler(w http.ResponseWriter, r *http.Request) {
 
 	query := strings.TrimSpace(r.FormValue("query"))
 	if len(query) == 0 {
-		fmt.Fprint(w, "No search query was provided")
-		w.WriteHeader(http.StatusBadRequest)
+		http.Error(w, "No search query was provided", http.StatusBadRequest)
+		return
+	}
+
+	searchQuery, err := ParseSearchQuery(query)
+	if err != nil {
+		writeSearchQueryError(w, r, err)
+		return
+	}
+	observeSearchQuery(searchQuery)
+	if _, err := parseFilters(searchQuery); err != nil {
+		writeSearchQueryError(w, r, err)
+		return
+	}
+
+	results, err := Search(r.Context(), searchQuery)
+	if err != nil {
+		loggerFrom(r.Context()).Error("could not search db", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, recipesV1(results))
+}
+
+// writeSearchQueryError answers 400 with every violation of a search query
+// and its JSON pointer, so clients can point at the offending members.
+func writeSearchQueryError(w http.ResponseWriter, r *http.Request, err error) {
+	loggerFrom(r.Context()).Warn("search query is not valid", "error", err)
+
+	errs, ok := err.(SchemaErrors)
+	if !ok {
+		errs = SchemaErrors{{"", err.Error()}}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(struct {
+		Errors SchemaErrors `json:"errors"`
+	}{errs})
+}
+
+// ImportHandler inserts the recipes of a CSV, JSON Lines or schema.org
+// JSON-LD body. By default the import is rejected as a whole when a row is
+// not valid, ?mode=partial imports the valid rows and reports the other ones.
+func ImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !isAuthorized(w, r) {
+		return
+	}
+	extendBulkDeadlines(w, r)
+
+	atomic := true
+	switch r.URL.Query().Get("mode") {
+	case "", "atomic":
+	case "partial":
+		atomic = false
+	default:
+		http.Error(w, "mode must be atomic or partial", http.StatusBadRequest)
+		return
+	}
+
+	var rows RecipeRows
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case csvMediaType:
+		csvRows, err := newCSVRecipeRows(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rows = csvRows
+	case jsonlMediaType, "application/jsonl", "application/x-jsonlines":
+		rows = newJSONLRecipeRows(r.Body)
+	case jsonldMediaType:
+		difficulty := int64(defaultJSONLDDifficulty)
+		if val := r.URL.Query().Get("difficulty"); len(val) != 0 {
+			var err error
+			difficulty, err = strconv.ParseInt(val, 10, 8)
+			if err != nil || difficulty < 1 || difficulty > 3 {
+				http.Error(w, "difficulty is not valid", http.StatusBadRequest)
+				return
+			}
+		}
+
+		jsonldRows, err := newJSONLDRecipeRows(r.Body, int8(difficulty))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rows = jsonldRows
+	default:
+		http.Error(w, fmt.Sprintf("unsupported import content type %s, use %s, %s or %s", mediaType, csvMediaType, jsonlMediaType, jsonldMediaType),
+			http.StatusUnsupportedMediaType)
+		return
+	}
+
+	result, err := ImportRecipes(r.Context(), rows, atomic)
+	status := http.StatusOK
+	if err == ErrImportRejected {
+		status = http.StatusUnprocessableEntity
+	} else if err != nil {
+		loggerFrom(r.Context()).Error("could not import recipes", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	loggerFrom(r.Context()).Info("imported recipes", "imported", result.Imported, "failed", result.Failed)
+
+	writeResponse(w, r, status, result)
+}
+
+// ExportHandler streams the recipes as CSV (default) or JSON Lines with
+// ?format=jsonl, optionally filtered by the same query as search.
+func ExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	mediaType, extension := csvMediaType, "csv"
+	switch r.FormValue("format") {
+	case "", "csv":
+	case "jsonl":
+		mediaType, extension = jsonlMediaType, "jsonl"
+	default:
+		http.Error(w, "format must be csv or jsonl", http.StatusBadRequest)
 		return
 	}
 
 	searchQuery := SearchQuery{}
-	err := json.Unmarshal([]byte(query), &searchQuery)
+	if query := strings.TrimSpace(r.FormValue("query")); len(query) != 0 {
+		var err error
+		if searchQuery, err = ParseSearchQuery(query); err != nil {
+			writeSearchQueryError(w, r, err)
+			return
+		}
+	}
+	if _, err := parseFilters(searchQuery); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	extendBulkDeadlines(w, r)
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="recipes.%s"`, extension))
+	if err := ExportRecipes(r.Context(), searchQuery, mediaType, w); err != nil {
+		// The status is already sent, the client gets a truncated export
+		loggerFrom(r.Context()).Error("could not export recipes", "error", err)
+	}
+}
+
+// APIKeysHandler lists the API keys of the user on GET and creates one on
+// POST. The created key is only ever returned in that response.
+func APIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, ok := userSession(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == "GET" {
+		apiKeys, err := db.GetAPIKeys(r.Context(), session.User.ID)
+		if err != nil {
+			loggerFrom(r.Context()).Error("could not list api keys", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeResponse(w, r, http.StatusOK, apiKeysV1(apiKeys))
+		return
+	}
+
+	name, scopes, err := apiKeyFromRequest(r)
 	if err != nil {
-		log.Println("could not unmarshal search query", err)
-		fmt.Fprint(w, "Invalid search query")
-		w.WriteHeader(http.StatusBadRequest)
+		loggerFrom(r.Context()).Warn("invalid api key", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	results, err := Search(searchQuery)
+	apiKey, key, err := CreateAPIKey(r.Context(), session.User.ID, name, scopes)
 	if err != nil {
-		log.Println("could not search db:", err)
+		loggerFrom(r.Context()).Error("could not create api key", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	b, err := json.Marshal(results)
+	w.Header().Set("Location", fmt.Sprintf("%s/me/api-keys/%d", v1Prefix, apiKey.ID))
+	writeResponse(w, r, http.StatusCreated, CreatedAPIKeyV1{APIKeyV1: apiKeyV1(apiKey), Key: key})
+}
+
+// APIKeyHandler revokes an API key of the user on DELETE.
+func APIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, ok := userSession(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 32)
 	if err != nil {
-		log.Println("could not convert results to JSON", err)
+		http.Error(w, "id is not valid", http.StatusBadRequest)
+		return
+	}
+
+	err = db.RevokeAPIKey(r.Context(), session.User.ID, id, time.Now().UTC())
+	if err == ErrAPIKeyNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		loggerFrom(r.Context()).Error("could not revoke api key", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Type", "text/json")
-	w.Write(b)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SessionsHandler lists the sessions of the user on GET, and ends all of
+// them, logging the user out everywhere, on DELETE.
+func SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "DELETE" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, ok := userSession(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == "GET" {
+		sessions, err := sessionManager.UserSessions(r.Context(), session.User.ID)
+		if err != nil {
+			loggerFrom(r.Context()).Error("could not list sessions", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeResponse(w, r, http.StatusOK, sessionsV1(sessions, session))
+		return
+	}
+
+	if err := sessionManager.RevokeUserSessions(r.Context(), session.User.ID); err != nil {
+		loggerFrom(r.Context()).Error("could not revoke sessions", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	sessionManager.clearCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SessionHandler ends a session of the user on DELETE.
+func SessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, ok := userSession(w, r)
+	if !ok {
+		return
+	}
+
+	revoked, err := sessionManager.RevokeSession(r.Context(), session.User.ID, mux.Vars(r)["id"])
+	if err == ErrSessionNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		loggerFrom(r.Context()).Error("could not revoke session", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if len(revoked.SessionKey) != 0 && revoked.SessionKey == session.SessionKey {
+		sessionManager.clearCookie(w)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UserSessionsHandler lets admins end every session of a user on DELETE,
+// e.g. when their account was compromised.
+func UserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, ok := userSession(w, r)
+	if !ok {
+		return
+	}
+	if !session.User.IsAdmin {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "id is not valid", http.StatusBadRequest)
+		return
+	}
+
+	if err := sessionManager.RevokeUserSessions(r.Context(), userID); err != nil {
+		loggerFrom(r.Context()).Error("could not revoke user sessions", "error", err, "revoked_user_id", userID)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	loggerFrom(r.Context()).Info("revoked user sessions", "revoked_user_id", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// userSession returns the session of a user who logged in. API keys can not
+// manage API keys or sessions, so a leaked key can not be used to mint new
+// keys or to end the sessions of its user.
+func userSession(w http.ResponseWriter, r *http.Request) (Session, bool) {
+	session, err := authSession(w, r)
+	if err != nil {
+		loggerFrom(r.Context()).Warn("failed to authenticate session", "error", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return session, false
+	}
+	if session.APIKeyID != 0 {
+		http.Error(w, "API keys and sessions can only be managed after logging in", http.StatusForbidden)
+		return session, false
+	}
+
+	return session, true
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// apiKeyPrefix starts every API key so they are recognizable, e.g. by
+// secret scanners, and told apart from other bearer tokens.
+const apiKeyPrefix = "rk_"
+
+const (
+	scopeRecipesRead  = "recipes:read"
+	scopeRecipesWrite = "recipes:write"
+)
+
+// apiKeyScopes are the scopes an API key can be given.
+var apiKeyScopes = []string{scopeRecipesRead, scopeRecipesWrite}
+
+var (
+	ErrAPIKeyNotFound    = errors.New("API key does not exist")
+	ErrInsufficientScope = errors.New("API key does not have the required scope")
+)
+
+// APIKey is a personal API key. The key itself is only known when it is
+// created, Prefix identifies it afterwards.
+type APIKey struct {
+	ID         int64
+	UserID     int64
+	Name       string
+	Prefix     string
+	Scopes     []string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+// newToken returns a random token starting with prefix and the hash stored
+// in its place.
+func newToken(prefix string) (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = prefix + base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+// hashToken hashes a token with SHA-256. Tokens are random so, unlike
+// passwords, they do not need a slow salted hash.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, len(token) != 0
+}
+
+// parseScopes reads space or comma separated scopes, rejecting unknown ones.
+func parseScopes(value string) ([]string, error) {
+	scopes := []string{}
+	seen := map[string]bool{}
+	for _, scope := range strings.FieldsFunc(value, func(c rune) bool { return c == ' ' || c == ',' }) {
+		if !isAPIKeyScope(scope) {
+			return nil, &ValidationError{"scopes", fmt.Sprintf("scope %s is not valid, use %s", scope, strings.Join(apiKeyScopes, ", "))}
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, notSet("scopes")
+	}
+	return scopes, nil
+}
+
+func isAPIKeyScope(scope string) bool {
+	for _, s := range apiKeyScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyFromRequest reads the name and scopes of a new key from a JSON
+// object or form values, where scopes are separated by spaces or commas.
+func apiKeyFromRequest(r *http.Request) (string, []string, error) {
+	var name, scopes string
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		var body struct {
+			Name   string   `json:"name"`
+			Scopes []string `json:"scopes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return "", nil, &ValidationError{"", "body is not valid JSON"}
+		}
+		name, scopes = body.Name, strings.Join(body.Scopes, " ")
+	} else {
+		if err := r.ParseForm(); err != nil {
+			return "", nil, &ValidationError{"", "body is not a valid form"}
+		}
+		name, scopes = r.Form.Get("name"), strings.Join(r.Form["scopes"], " ")
+	}
+
+	name = strings.TrimSpace(name)
+	if len(name) == 0 {
+		return "", nil, notSet("name")
+	}
+	if utf8.RuneCountInString(name) > 128 {
+		return "", nil, &ValidationError{"name", "name is longer than 128 characters"}
+	}
+
+	parsed, err := parseScopes(scopes)
+	return name, parsed, err
+}
+
+// requiredScope is the scope an API key needs for a request to a protected
+// recipe endpoint: reads need recipes:read, anything else recipes:write.
+func requiredScope(r *http.Request) string {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return scopeRecipesRead
+	}
+	return scopeRecipesWrite
+}
+
+// CreateAPIKey creates a key of the user and returns it with the key, which
+// can not be retrieved later.
+func CreateAPIKey(ctx context.Context, userID int64, name string, scopes []string) (APIKey, string, error) {
+	key, hash, err := newToken(apiKeyPrefix)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+
+	apiKey := APIKey{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    key[:len(apiKeyPrefix)+8],
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+	apiKey.ID, err = db.InsertAPIKey(ctx, apiKey, hash)
+	return apiKey, key, err
+}
+
+// authAPIKey returns the session of the user owning an unrevoked key.
+func authAPIKey(ctx context.Context, key string) (Session, error) {
+	return db.GetAPIKeySession(ctx, hashToken(key), time.Now().UTC())
+}
@@ -1,40 +1,92 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"strings"
 )
 
+var ErrUserDisabled = errors.New("user is disabled")
+
 type User struct {
 	ID           int64
 	Username     string
 	Fullname     string
 	PasswordHash string
+	IsAdmin      bool
 }
 
+// isAuthorized reports whether the request has a session allowed the scope
+// the request requires. Otherwise it answers 401 or 403.
 func isAuthorized(w http.ResponseWriter, r *http.Request) bool {
-	if err := authSession(w, r); err != nil {
-		log.Println("failed to authenticate session:", err)
-		return false
+	_, ok := authorizedSession(w, r)
+	return ok
+}
+
+// authorizedSession is isAuthorized returning the session, e.g. for the
+// handlers also checking that its user is an admin.
+func authorizedSession(w http.ResponseWriter, r *http.Request) (Session, bool) {
+	session, err := authSession(w, r)
+	if err != nil {
+		loggerFrom(r.Context()).Warn("failed to authenticate session", "error", err)
+		if _, ok := bearerToken(r); ok {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return session, false
+	}
+
+	scope := requiredScope(r)
+	if !session.HasScope(scope) {
+		loggerFrom(r.Context()).Warn("failed to authorize session", "error", ErrInsufficientScope, "scope", scope)
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+		w.WriteHeader(http.StatusForbidden)
+		return session, false
 	}
 
-	return true
+	return session, true
 }
 
-func authSession(w http.ResponseWriter, r *http.Request) error {
+// authSession returns the session of the API key or access token given as
+// a bearer token, or else of the session cookie.
+func authSession(w http.ResponseWriter, r *http.Request) (Session, error) {
+	if token, ok := bearerToken(r); ok {
+		session, err := authBearerToken(r.Context(), token)
+		if err != nil {
+			return session, err
+		}
+		setRequestUser(r.Context(), session.User.ID)
+		return session, nil
+	}
+
 	sid, err := sessionManager.getSessionID(r)
 	if err != nil {
-		return err
+		return Session{}, err
 	}
 	if len(sid) == 0 {
-		return fmt.Errorf("session token not found: %s", sid)
+		return Session{}, fmt.Errorf("session token not found: %s", sid)
 	}
 
-	_, err = sessionManager.ReadSession(sid)
+	session, err := sessionManager.ReadSession(r.Context(), sid)
 	if err != nil {
-		return err
+		return session, err
 	}
+	sessionManager.refreshCookie(w, sid)
+	setRequestUser(r.Context(), session.User.ID)
+
+	return session, nil
+}
 
-	return nil
+// authBearerToken authenticates an API key or, in the jwt session mode, an
+// access token.
+func authBearerToken(ctx context.Context, token string) (Session, error) {
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		return authAPIKey(ctx, token)
+	}
+	if config.Session.Mode == sessionModeJWT {
+		return authAccessToken(token)
+	}
+	return Session{}, fmt.Errorf("bearer token is not an API key")
 }
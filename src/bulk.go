@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	csvMediaType   = "text/csv"
+	jsonlMediaType = "application/x-ndjson"
+)
+
+// exportColumns are the columns of exported recipes, named like the members
+// of the API representation. Import takes the recipe fields and ignores the
+// other ones, so exports can be imported back.
+var exportColumns = []string{"id", "name", "prep_time", "difficulty", "vegetarian", "rating", "rating_count", "created_at", "updated_at"}
+
+// legacyExportColumns are columns older exports had, ignored on import.
+var legacyExportColumns = []string{"ratings"}
+
+var recipeFieldColumns = map[string]bool{
+	"name":       true,
+	"prep_time":  true,
+	"difficulty": true,
+	"vegetarian": true,
+}
+
+// ErrImportRejected is returned by an atomic import having invalid rows,
+// none of its rows are imported.
+var ErrImportRejected = errors.New("import has invalid rows")
+
+// ExportedRecipe is a recipe with its ratings aggregates as exported.
+type ExportedRecipe struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	PrepTime    int       `json:"prep_time"`
+	Difficulty  int8      `json:"difficulty"`
+	Vegeterian  bool      `json:"vegetarian"`
+	Rating      float64   `json:"rating"`
+	RatingCount int64     `json:"rating_count"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func (recipe ExportedRecipe) csvRecord() []string {
+	return []string{
+		strconv.FormatInt(recipe.ID, 10),
+		recipe.Name,
+		strconv.Itoa(recipe.PrepTime),
+		strconv.Itoa(int(recipe.Difficulty)),
+		strconv.FormatBool(recipe.Vegeterian),
+		strconv.FormatFloat(recipe.Rating, 'f', -1, 64),
+		strconv.FormatInt(recipe.RatingCount, 10),
+		recipe.CreatedAt.Format(time.RFC3339),
+		recipe.UpdatedAt.Format(time.RFC3339),
+	}
+}
+
+// ImportRowError reports an invalid row, rows are numbered from 1 not
+// counting the CSV header.
+type ImportRowError struct {
+	Row     int    `json:"row"`
+	Message string `json:"error"`
+}
+
+func (err *ImportRowError) Error() string {
+	return fmt.Sprintf("row %d: %s", err.Row, err.Message)
+}
+
+type ImportResult struct {
+	Imported int              `json:"imported"`
+	Failed   int              `json:"failed"`
+	Errors   []ImportRowError `json:"errors"`
+}
+
+// RecipeRows reads the rows of an import one at a time. Next returns io.EOF
+// after the last row, and an *ImportRowError for a row that is not valid.
+type RecipeRows interface {
+	Next() (RecipeFields, error)
+}
+
+type csvRecipeRows struct {
+	reader  *csv.Reader
+	columns map[string]int
+	row     int
+}
+
+// newCSVRecipeRows reads the header of a CSV import, which must have every
+// recipe field column under its current or legacy name.
+func newCSVRecipeRows(r io.Reader) (*csvRecipeRows, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read CSV header: %s", err)
+	}
+	reader.FieldsPerRecord = len(header)
+
+	columns := map[string]int{}
+	for i, column := range header {
+		column = recipeFieldName(strings.ToLower(strings.TrimSpace(column)))
+		if _, ok := columns[column]; ok {
+			return nil, fmt.Errorf("CSV header has more than one %s column", column)
+		}
+		columns[column] = i
+	}
+	for column := range recipeFieldColumns {
+		if _, ok := columns[column]; !ok {
+			return nil, fmt.Errorf("CSV header has no %s column", column)
+		}
+	}
+
+	return &csvRecipeRows{reader: reader, columns: columns}, nil
+}
+
+func (rows *csvRecipeRows) Next() (RecipeFields, error) {
+	record, err := rows.reader.Read()
+	if err == io.EOF {
+		return RecipeFields{}, err
+	}
+	rows.row++
+
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return RecipeFields{}, &ImportRowError{rows.row, parseErr.Err.Error()}
+	}
+	if err != nil {
+		return RecipeFields{}, err
+	}
+
+	fields, err := recipeFieldsFromValues(func(field string) string {
+		i, ok := rows.columns[field]
+		if !ok {
+			return ""
+		}
+		return record[i]
+	})
+	if err == nil {
+		err = fields.Validate()
+	}
+	if err != nil {
+		return fields, &ImportRowError{rows.row, err.Error()}
+	}
+
+	return fields, nil
+}
+
+type jsonlRecipeRows struct {
+	scanner *bufio.Scanner
+	row     int
+}
+
+func newJSONLRecipeRows(r io.Reader) *jsonlRecipeRows {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return &jsonlRecipeRows{scanner: scanner}
+}
+
+func (rows *jsonlRecipeRows) Next() (RecipeFields, error) {
+	line := ""
+	for len(line) == 0 {
+		if !rows.scanner.Scan() {
+			if err := rows.scanner.Err(); err != nil {
+				return RecipeFields{}, err
+			}
+			return RecipeFields{}, io.EOF
+		}
+		rows.row++
+		line = strings.TrimSpace(rows.scanner.Text())
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal([]byte(line), &doc); err != nil {
+		return RecipeFields{}, &ImportRowError{rows.row, "line is not valid JSON"}
+	}
+
+	// Exported columns other than the recipe fields are ignored
+	if obj, ok := doc.(map[string]interface{}); ok {
+		for _, column := range append(exportColumns, legacyExportColumns...) {
+			if !recipeFieldColumns[column] {
+				delete(obj, column)
+			}
+		}
+	}
+
+	fields, err := recipeFieldsFromDocument(doc)
+	if err == nil {
+		err = fields.Validate()
+	}
+	if err != nil {
+		return fields, &ImportRowError{rows.row, err.Error()}
+	}
+
+	return fields, nil
+}
+
+// extendBulkDeadlines replaces the server read and write timeouts of an
+// import or export request, which are meant for single recipe calls, by
+// the bulk timeout that also bounds its db work.
+func extendBulkDeadlines(w http.ResponseWriter, r *http.Request) {
+	deadline := time.Now().Add(time.Duration(config.DB.BulkTimeout) * time.Second)
+	controller := http.NewResponseController(w)
+	for _, err := range []error{controller.SetReadDeadline(deadline), controller.SetWriteDeadline(deadline)} {
+		if err != nil && !errors.Is(err, http.ErrNotSupported) {
+			loggerFrom(r.Context()).Warn("could not extend the request deadlines", "error", err)
+		}
+	}
+}
+
+// ImportRecipes inserts the valid rows in one transaction and reports the
+// invalid ones. When atomic is set any invalid row rolls the whole import
+// back and ErrImportRejected is returned.
+func ImportRecipes(ctx context.Context, rows RecipeRows, atomic bool) (ImportResult, error) {
+	return db.ImportRecipes(ctx, rows, atomic, time.Now().UTC())
+}
+
+// ExportRecipes writes the recipes matching searchQuery, all of them when it
+// has no groups, as CSV or JSON Lines.
+func ExportRecipes(ctx context.Context, searchQuery SearchQuery, mediaType string, w io.Writer) error {
+	filters, err := parseFilters(searchQuery)
+	if err != nil {
+		return err
+	}
+
+	if mediaType == csvMediaType {
+		writer := csv.NewWriter(w)
+		if err := writer.Write(exportColumns); err != nil {
+			return err
+		}
+		err = db.ExportRecipes(ctx, filters, func(recipe ExportedRecipe) error {
+			return writer.Write(recipe.csvRecord())
+		})
+		writer.Flush()
+		if err != nil {
+			return err
+		}
+		return writer.Error()
+	}
+
+	encoder := json.NewEncoder(w)
+	return db.ExportRecipes(ctx, filters, func(recipe ExportedRecipe) error {
+		return encoder.Encode(recipe)
+	})
+}
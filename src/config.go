@@ -0,0 +1,707 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/redis/go-redis/v9"
+	"gopkg.in/yaml.v2"
+)
+
+const redacted = "******"
+
+type Config struct {
+	Port    string        `yaml:"port" toml:"port"`
+	HTTP    HTTPConfig    `yaml:"http" toml:"http"`
+	DB      DBConfig      `yaml:"db" toml:"db"`
+	Session SessionConfig `yaml:"session" toml:"session"`
+	OIDC    OIDCConfig    `yaml:"oidc" toml:"oidc"`
+	Trash   TrashConfig   `yaml:"trash" toml:"trash"`
+}
+
+// HTTPConfig holds the HTTP server timeouts in seconds.
+type HTTPConfig struct {
+	ReadTimeout     int64 `yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout    int64 `yaml:"write_timeout" toml:"write_timeout"`
+	IdleTimeout     int64 `yaml:"idle_timeout" toml:"idle_timeout"`
+	ShutdownTimeout int64 `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	// ShutdownDelay is how long /readyz fails before the listener closes,
+	// so load balancers stop sending requests first
+	ShutdownDelay int64 `yaml:"shutdown_delay" toml:"shutdown_delay"`
+
+	// RequireIfMatch rejects recipe updates and deletes without If-Match
+	RequireIfMatch bool `yaml:"require_if_match" toml:"require_if_match"`
+
+	// LegacySunset is the date, like 2027-06-30, after which the unversioned
+	// routes may be removed, sent in their Sunset header. Empty sends none.
+	LegacySunset string `yaml:"legacy_sunset" toml:"legacy_sunset"`
+}
+
+// sunsetLayout is the layout of HTTPConfig.LegacySunset.
+const sunsetLayout = "2006-01-02"
+
+type DBConfig struct {
+	DSN  string `yaml:"dsn" toml:"dsn"`
+	Host string `yaml:"host" toml:"host"`
+	Port string `yaml:"port" toml:"port"`
+	User string `yaml:"user" toml:"user"`
+	Pass string `yaml:"pass" toml:"pass"`
+	Name string `yaml:"name" toml:"name"`
+
+	// SSL settings, see https://www.postgresql.org/docs/current/libpq-ssl.html
+	SSLMode     string `yaml:"sslmode" toml:"sslmode"`
+	SSLRootCert string `yaml:"sslrootcert" toml:"sslrootcert"`
+	SSLCert     string `yaml:"sslcert" toml:"sslcert"`
+	SSLKey      string `yaml:"sslkey" toml:"sslkey"`
+
+	// Connection pool settings, lifetimes in seconds (0 means unlimited)
+	MaxOpenConns    int   `yaml:"max_open_conns" toml:"max_open_conns"`
+	MaxIdleConns    int   `yaml:"max_idle_conns" toml:"max_idle_conns"`
+	ConnMaxLifetime int64 `yaml:"conn_max_lifetime" toml:"conn_max_lifetime"`
+	ConnMaxIdleTime int64 `yaml:"conn_max_idle_time" toml:"conn_max_idle_time"`
+
+	// StartupMaxWait is how long to retry reaching the db on start, in seconds
+	StartupMaxWait int64 `yaml:"startup_max_wait" toml:"startup_max_wait"`
+
+	// QueryTimeout bounds every db call, in seconds
+	QueryTimeout int64 `yaml:"query_timeout" toml:"query_timeout"`
+
+	// BulkTimeout bounds a whole import or export instead, in seconds
+	BulkTimeout int64 `yaml:"bulk_timeout" toml:"bulk_timeout"`
+
+	// AutoMigrate applies pending migrations on start
+	AutoMigrate bool `yaml:"auto_migrate" toml:"auto_migrate"`
+}
+
+var sslModes = map[string]bool{
+	"disable":     true,
+	"allow":       true,
+	"prefer":      true,
+	"require":     true,
+	"verify-ca":   true,
+	"verify-full": true,
+}
+
+type SessionConfig struct {
+	CookieSID       string `yaml:"cookie_sid" toml:"cookie_sid"`
+	CookieMaxAge    int64  `yaml:"cookie_max_age" toml:"cookie_max_age"`
+	CleanupInterval int64  `yaml:"cleanup_sessions" toml:"cleanup_sessions"`
+
+	// Store keeps cookie sessions: memory, sql or redis. Replicas share
+	// sessions with sql and redis only.
+	Store    string `yaml:"store" toml:"store"`
+	RedisURL string `yaml:"redis_url" toml:"redis_url"`
+
+	// Mode is what /login opens: a cookie session, or with "jwt" an access
+	// token and a refresh token
+	Mode string `yaml:"mode" toml:"mode"`
+
+	// JWTKeys are the HMAC keys of access tokens by kid. New tokens are
+	// signed with JWTSigningKey, the other keys only verify tokens so keys
+	// can be rotated.
+	JWTKeys       map[string]string `yaml:"jwt_keys" toml:"jwt_keys"`
+	JWTSigningKey string            `yaml:"jwt_signing_key" toml:"jwt_signing_key"`
+
+	// Token lifetimes in seconds
+	AccessTokenTTL  int64 `yaml:"access_token_ttl" toml:"access_token_ttl"`
+	RefreshTokenTTL int64 `yaml:"refresh_token_ttl" toml:"refresh_token_ttl"`
+}
+
+const (
+	sessionModeCookie = "cookie"
+	sessionModeJWT    = "jwt"
+)
+
+const (
+	sessionStoreMemory = "memory"
+	sessionStoreSQL    = "sql"
+	sessionStoreRedis  = "redis"
+)
+
+// minJWTKeyLength is the minimum length of HMAC keys, the size of the
+// SHA-256 output.
+const minJWTKeyLength = 32
+
+// OIDCConfig is the OpenID Connect provider users can log in with. Login
+// with OIDC is disabled when Issuer is empty.
+type OIDCConfig struct {
+	Issuer       string `yaml:"issuer" toml:"issuer"`
+	ClientID     string `yaml:"client_id" toml:"client_id"`
+	ClientSecret string `yaml:"client_secret" toml:"client_secret"`
+
+	// RedirectURL is the public URL of /v1/auth/oidc/callback
+	RedirectURL string `yaml:"redirect_url" toml:"redirect_url"`
+}
+
+// TrashConfig holds how long deleted recipes are kept and how often the
+// trash is purged, in seconds.
+type TrashConfig struct {
+	Retention     int64 `yaml:"retention" toml:"retention"`
+	PurgeInterval int64 `yaml:"purge_interval" toml:"purge_interval"`
+}
+
+// ConfigErrors collects every problem found while loading and validating
+// the configuration so they can be reported at once.
+type ConfigErrors []string
+
+func (errs ConfigErrors) Error() string {
+	return strings.Join(errs, "; ")
+}
+
+func (errs *ConfigErrors) add(format string, args ...interface{}) {
+	*errs = append(*errs, fmt.Sprintf(format, args...))
+}
+
+func DefaultConfig() Config {
+	return Config{
+		HTTP: HTTPConfig{
+			ReadTimeout:     15,
+			WriteTimeout:    30,
+			IdleTimeout:     60,
+			ShutdownTimeout: 30,
+			ShutdownDelay:   5,
+			LegacySunset:    "2027-06-30",
+		},
+		DB: DBConfig{
+			Port:            "5432",
+			SSLMode:         "disable",
+			MaxOpenConns:    20,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: 1800,
+			ConnMaxIdleTime: 300,
+			StartupMaxWait:  60,
+			QueryTimeout:    5,
+			BulkTimeout:     300,
+		},
+		Session: SessionConfig{
+			CookieMaxAge:    3600,
+			CleanupInterval: 3600,
+			Store:           sessionStoreSQL,
+			Mode:            sessionModeCookie,
+			AccessTokenTTL:  300,
+			RefreshTokenTTL: 30 * 24 * 3600,
+		},
+		Trash: TrashConfig{
+			Retention:     30 * 24 * 3600,
+			PurgeInterval: 3600,
+		},
+	}
+}
+
+// LoadConfig builds the configuration from defaults, then the config file
+// (-config flag or CONFIG_FILE), then environment variables and finally
+// command-line flags. printConfig reports whether -print-config was given.
+func LoadConfig(args []string) (cfg Config, printConfig bool, err error) {
+	cfg = DefaultConfig()
+	errs := ConfigErrors{}
+
+	fs := flag.NewFlagSet("recipe-api", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML config file")
+	fs.BoolVar(&printConfig, "print-config", false, "print the effective config with secrets redacted and exit")
+	port := fs.String("port", "", "HTTP port to listen on")
+	readTimeout := fs.Int64("http-read-timeout", 0, "HTTP server read timeout in seconds")
+	writeTimeout := fs.Int64("http-write-timeout", 0, "HTTP server write timeout in seconds")
+	idleTimeout := fs.Int64("http-idle-timeout", 0, "HTTP server keep-alive idle timeout in seconds")
+	shutdownTimeout := fs.Int64("shutdown-timeout", 0, "seconds to drain in-flight requests on shutdown")
+	shutdownDelay := fs.Int64("shutdown-delay", 0, "seconds /readyz fails before the listener closes on shutdown")
+	requireIfMatch := fs.Bool("require-if-match", false, "reject recipe updates and deletes without an If-Match header")
+	legacySunset := fs.String("legacy-sunset", "", "date (YYYY-MM-DD) sent in the Sunset header of unversioned routes")
+	dsn := fs.String("db-dsn", "", "database connection string (overrides the other db flags)")
+	dbHost := fs.String("db-host", "", "database host")
+	dbPort := fs.String("db-port", "", "database port")
+	dbUser := fs.String("db-user", "", "database user")
+	dbPass := fs.String("db-pass", "", "database password")
+	dbName := fs.String("db-name", "", "database name")
+	sslMode := fs.String("db-sslmode", "", "database sslmode (disable, allow, prefer, require, verify-ca, verify-full)")
+	sslRootCert := fs.String("db-sslrootcert", "", "path to the database server root certificate")
+	sslCert := fs.String("db-sslcert", "", "path to the database client certificate")
+	sslKey := fs.String("db-sslkey", "", "path to the database client key")
+	maxOpenConns := fs.Int("db-max-open-conns", 0, "maximum open database connections (0 means unlimited)")
+	maxIdleConns := fs.Int("db-max-idle-conns", 0, "maximum idle database connections")
+	connMaxLifetime := fs.Int64("db-conn-max-lifetime", 0, "maximum database connection lifetime in seconds")
+	connMaxIdleTime := fs.Int64("db-conn-max-idle-time", 0, "maximum database connection idle time in seconds")
+	startupMaxWait := fs.Int64("db-startup-max-wait", 0, "seconds to keep retrying the database on start")
+	queryTimeout := fs.Int64("db-query-timeout", 0, "timeout of each database call in seconds")
+	bulkTimeout := fs.Int64("db-bulk-timeout", 0, "timeout of a whole import or export in seconds")
+	autoMigrate := fs.Bool("db-auto-migrate", false, "apply pending migrations on start")
+	cookieSID := fs.String("cookie-sid", "", "session cookie name")
+	cookieMaxAge := fs.Int64("cookie-max-age", 0, "session lifetime in seconds")
+	cleanup := fs.Int64("cleanup-sessions", 0, "expired sessions clean up interval in seconds")
+	sessionStore := fs.String("session-store", "", "where cookie sessions are kept: memory, sql or redis")
+	redisURL := fs.String("redis-url", "", "redis:// URL of the redis session store")
+	sessionMode := fs.String("session-mode", "", "what login opens: cookie sessions or jwt access and refresh tokens")
+	jwtKeys := fs.String("jwt-keys", "", "access token HMAC keys as kid=key pairs separated by commas")
+	jwtSigningKey := fs.String("jwt-signing-key", "", "kid of the key signing new access tokens")
+	accessTokenTTL := fs.Int64("access-token-ttl", 0, "access token lifetime in seconds")
+	refreshTokenTTL := fs.Int64("refresh-token-ttl", 0, "refresh token lifetime in seconds")
+	oidcIssuer := fs.String("oidc-issuer", "", "OpenID Connect issuer URL, enables login with OIDC")
+	oidcClientID := fs.String("oidc-client-id", "", "OpenID Connect client ID")
+	oidcClientSecret := fs.String("oidc-client-secret", "", "OpenID Connect client secret")
+	oidcRedirectURL := fs.String("oidc-redirect-url", "", "public URL of the OpenID Connect callback")
+	trashRetention := fs.Int64("trash-retention", 0, "seconds to keep deleted recipes in the trash")
+	trashPurgeInterval := fs.Int64("trash-purge-interval", 0, "trash purge interval in seconds")
+	if err := fs.Parse(args); err != nil {
+		return cfg, false, err
+	}
+
+	if len(*configFile) != 0 {
+		if err := loadConfigFile(*configFile, &cfg, &errs); err != nil {
+			errs.add("could not load config file %s: %s", *configFile, err)
+		}
+	}
+
+	applyEnv(&cfg, &errs)
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Port = *port
+		case "http-read-timeout":
+			cfg.HTTP.ReadTimeout = *readTimeout
+		case "http-write-timeout":
+			cfg.HTTP.WriteTimeout = *writeTimeout
+		case "http-idle-timeout":
+			cfg.HTTP.IdleTimeout = *idleTimeout
+		case "shutdown-timeout":
+			cfg.HTTP.ShutdownTimeout = *shutdownTimeout
+		case "shutdown-delay":
+			cfg.HTTP.ShutdownDelay = *shutdownDelay
+		case "require-if-match":
+			cfg.HTTP.RequireIfMatch = *requireIfMatch
+		case "legacy-sunset":
+			cfg.HTTP.LegacySunset = *legacySunset
+		case "db-dsn":
+			cfg.DB.DSN = *dsn
+		case "db-host":
+			cfg.DB.Host = *dbHost
+		case "db-port":
+			cfg.DB.Port = *dbPort
+		case "db-user":
+			cfg.DB.User = *dbUser
+		case "db-pass":
+			cfg.DB.Pass = *dbPass
+		case "db-name":
+			cfg.DB.Name = *dbName
+		case "db-sslmode":
+			cfg.DB.SSLMode = *sslMode
+		case "db-sslrootcert":
+			cfg.DB.SSLRootCert = *sslRootCert
+		case "db-sslcert":
+			cfg.DB.SSLCert = *sslCert
+		case "db-sslkey":
+			cfg.DB.SSLKey = *sslKey
+		case "db-max-open-conns":
+			cfg.DB.MaxOpenConns = *maxOpenConns
+		case "db-max-idle-conns":
+			cfg.DB.MaxIdleConns = *maxIdleConns
+		case "db-conn-max-lifetime":
+			cfg.DB.ConnMaxLifetime = *connMaxLifetime
+		case "db-conn-max-idle-time":
+			cfg.DB.ConnMaxIdleTime = *connMaxIdleTime
+		case "db-startup-max-wait":
+			cfg.DB.StartupMaxWait = *startupMaxWait
+		case "db-query-timeout":
+			cfg.DB.QueryTimeout = *queryTimeout
+		case "db-bulk-timeout":
+			cfg.DB.BulkTimeout = *bulkTimeout
+		case "db-auto-migrate":
+			cfg.DB.AutoMigrate = *autoMigrate
+		case "cookie-sid":
+			cfg.Session.CookieSID = *cookieSID
+		case "cookie-max-age":
+			cfg.Session.CookieMaxAge = *cookieMaxAge
+		case "cleanup-sessions":
+			cfg.Session.CleanupInterval = *cleanup
+		case "session-store":
+			cfg.Session.Store = *sessionStore
+		case "redis-url":
+			cfg.Session.RedisURL = *redisURL
+		case "session-mode":
+			cfg.Session.Mode = *sessionMode
+		case "jwt-keys":
+			keys, err := parseJWTKeys(*jwtKeys)
+			if err != nil {
+				errs.add("-jwt-keys %s", err)
+			}
+			cfg.Session.JWTKeys = keys
+		case "jwt-signing-key":
+			cfg.Session.JWTSigningKey = *jwtSigningKey
+		case "access-token-ttl":
+			cfg.Session.AccessTokenTTL = *accessTokenTTL
+		case "refresh-token-ttl":
+			cfg.Session.RefreshTokenTTL = *refreshTokenTTL
+		case "oidc-issuer":
+			cfg.OIDC.Issuer = *oidcIssuer
+		case "oidc-client-id":
+			cfg.OIDC.ClientID = *oidcClientID
+		case "oidc-client-secret":
+			cfg.OIDC.ClientSecret = *oidcClientSecret
+		case "oidc-redirect-url":
+			cfg.OIDC.RedirectURL = *oidcRedirectURL
+		case "trash-retention":
+			cfg.Trash.Retention = *trashRetention
+		case "trash-purge-interval":
+			cfg.Trash.PurgeInterval = *trashPurgeInterval
+		}
+	})
+
+	errs = append(errs, cfg.Validate()...)
+	if len(errs) != 0 {
+		return cfg, printConfig, errs
+	}
+
+	return cfg, printConfig, nil
+}
+
+// loadConfigFile reads a YAML or TOML config file into cfg. Unknown keys are
+// errors in both formats, TOML ones are added to errs.
+func loadConfigFile(path string, cfg *Config, errs *ConfigErrors) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return yaml.UnmarshalStrict(b, cfg)
+	case ".toml":
+		meta, err := toml.Decode(string(b), cfg)
+		if err != nil {
+			return err
+		}
+		for _, key := range meta.Undecoded() {
+			errs.add("config file %s has an unknown key: %s", path, key)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported config file extension: %s", filepath.Ext(path))
+	}
+}
+
+func applyEnv(cfg *Config, errs *ConfigErrors) {
+	setString := func(key string, dst *string) {
+		if val, ok := os.LookupEnv(key); ok && len(val) != 0 {
+			*dst = val
+		}
+	}
+	setInt := func(key string, dst *int64) {
+		val, ok := os.LookupEnv(key)
+		if !ok || len(val) == 0 {
+			return
+		}
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			errs.add("%s is not a valid integer: %s", key, val)
+			return
+		}
+		*dst = n
+	}
+	setBool := func(key string, dst *bool) {
+		val, ok := os.LookupEnv(key)
+		if !ok || len(val) == 0 {
+			return
+		}
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			errs.add("%s is not a valid boolean: %s", key, val)
+			return
+		}
+		*dst = b
+	}
+
+	maxOpenConns := int64(cfg.DB.MaxOpenConns)
+	maxIdleConns := int64(cfg.DB.MaxIdleConns)
+
+	setString("PORT", &cfg.Port)
+	setInt("HTTP_READ_TIMEOUT", &cfg.HTTP.ReadTimeout)
+	setInt("HTTP_WRITE_TIMEOUT", &cfg.HTTP.WriteTimeout)
+	setInt("HTTP_IDLE_TIMEOUT", &cfg.HTTP.IdleTimeout)
+	setInt("SHUTDOWN_TIMEOUT", &cfg.HTTP.ShutdownTimeout)
+	setInt("SHUTDOWN_DELAY", &cfg.HTTP.ShutdownDelay)
+	setBool("REQUIRE_IF_MATCH", &cfg.HTTP.RequireIfMatch)
+	setString("LEGACY_SUNSET", &cfg.HTTP.LegacySunset)
+	setString("DB_DSN", &cfg.DB.DSN)
+	setString("DB_HOST", &cfg.DB.Host)
+	setString("DB_PORT", &cfg.DB.Port)
+	setString("DB_USER", &cfg.DB.User)
+	setString("DB_PASS", &cfg.DB.Pass)
+	setString("DB_NAME", &cfg.DB.Name)
+	setString("DB_SSLMODE", &cfg.DB.SSLMode)
+	setString("DB_SSLROOTCERT", &cfg.DB.SSLRootCert)
+	setString("DB_SSLCERT", &cfg.DB.SSLCert)
+	setString("DB_SSLKEY", &cfg.DB.SSLKey)
+	setInt("DB_MAX_OPEN_CONNS", &maxOpenConns)
+	setInt("DB_MAX_IDLE_CONNS", &maxIdleConns)
+	setInt("DB_CONN_MAX_LIFETIME", &cfg.DB.ConnMaxLifetime)
+	setInt("DB_CONN_MAX_IDLE_TIME", &cfg.DB.ConnMaxIdleTime)
+	setInt("DB_STARTUP_MAX_WAIT", &cfg.DB.StartupMaxWait)
+	setInt("DB_QUERY_TIMEOUT", &cfg.DB.QueryTimeout)
+	setInt("DB_BULK_TIMEOUT", &cfg.DB.BulkTimeout)
+	setBool("DB_AUTO_MIGRATE", &cfg.DB.AutoMigrate)
+	cfg.DB.MaxOpenConns = int(maxOpenConns)
+	cfg.DB.MaxIdleConns = int(maxIdleConns)
+	setString("COOKIE_SID", &cfg.Session.CookieSID)
+	setInt("COOKIE_MAX_AGE", &cfg.Session.CookieMaxAge)
+	setInt("CLEANUP_SESSIONS", &cfg.Session.CleanupInterval)
+	setString("SESSION_STORE", &cfg.Session.Store)
+	setString("REDIS_URL", &cfg.Session.RedisURL)
+	setString("SESSION_MODE", &cfg.Session.Mode)
+	if val, ok := os.LookupEnv("JWT_KEYS"); ok && len(val) != 0 {
+		keys, err := parseJWTKeys(val)
+		if err != nil {
+			errs.add("JWT_KEYS %s", err)
+		}
+		cfg.Session.JWTKeys = keys
+	}
+	setString("JWT_SIGNING_KEY", &cfg.Session.JWTSigningKey)
+	setInt("ACCESS_TOKEN_TTL", &cfg.Session.AccessTokenTTL)
+	setInt("REFRESH_TOKEN_TTL", &cfg.Session.RefreshTokenTTL)
+	setString("OIDC_ISSUER", &cfg.OIDC.Issuer)
+	setString("OIDC_CLIENT_ID", &cfg.OIDC.ClientID)
+	setString("OIDC_CLIENT_SECRET", &cfg.OIDC.ClientSecret)
+	setString("OIDC_REDIRECT_URL", &cfg.OIDC.RedirectURL)
+	setInt("TRASH_RETENTION", &cfg.Trash.Retention)
+	setInt("TRASH_PURGE_INTERVAL", &cfg.Trash.PurgeInterval)
+}
+
+func (cfg Config) Validate() ConfigErrors {
+	errs := ConfigErrors{}
+
+	if len(cfg.Port) == 0 {
+		errs.add("port is not set")
+	} else if _, err := strconv.ParseUint(cfg.Port, 10, 16); err != nil {
+		errs.add("port is not valid: %s", cfg.Port)
+	}
+
+	if cfg.HTTP.ReadTimeout <= 0 {
+		errs.add("http read_timeout must be positive: %d", cfg.HTTP.ReadTimeout)
+	}
+	if cfg.HTTP.WriteTimeout <= 0 {
+		errs.add("http write_timeout must be positive: %d", cfg.HTTP.WriteTimeout)
+	}
+	if cfg.HTTP.IdleTimeout <= 0 {
+		errs.add("http idle_timeout must be positive: %d", cfg.HTTP.IdleTimeout)
+	}
+	if cfg.HTTP.ShutdownTimeout <= 0 {
+		errs.add("http shutdown_timeout must be positive: %d", cfg.HTTP.ShutdownTimeout)
+	}
+	if cfg.HTTP.ShutdownDelay < 0 {
+		errs.add("http shutdown_delay must not be negative: %d", cfg.HTTP.ShutdownDelay)
+	}
+	if len(cfg.HTTP.LegacySunset) != 0 {
+		if _, err := time.Parse(sunsetLayout, cfg.HTTP.LegacySunset); err != nil {
+			errs.add("http legacy_sunset is not a valid date: %s", cfg.HTTP.LegacySunset)
+		}
+	}
+
+	if len(cfg.DB.DSN) == 0 {
+		if len(cfg.DB.Host) == 0 {
+			errs.add("db host is not set")
+		}
+		if len(cfg.DB.Port) == 0 {
+			errs.add("db port is not set")
+		}
+		if len(cfg.DB.User) == 0 {
+			errs.add("db user is not set")
+		}
+		if len(cfg.DB.Pass) == 0 {
+			errs.add("db pass is not set")
+		}
+		if len(cfg.DB.Name) == 0 {
+			errs.add("db name is not set")
+		}
+		if !sslModes[cfg.DB.SSLMode] {
+			errs.add("db sslmode is not valid: %s", cfg.DB.SSLMode)
+		}
+	}
+
+	if cfg.DB.MaxOpenConns < 0 {
+		errs.add("db max_open_conns must not be negative: %d", cfg.DB.MaxOpenConns)
+	}
+	if cfg.DB.MaxIdleConns < 0 {
+		errs.add("db max_idle_conns must not be negative: %d", cfg.DB.MaxIdleConns)
+	}
+	if cfg.DB.MaxOpenConns > 0 && cfg.DB.MaxIdleConns > cfg.DB.MaxOpenConns {
+		errs.add("db max_idle_conns (%d) must not exceed max_open_conns (%d)", cfg.DB.MaxIdleConns, cfg.DB.MaxOpenConns)
+	}
+	if cfg.DB.ConnMaxLifetime < 0 {
+		errs.add("db conn_max_lifetime must not be negative: %d", cfg.DB.ConnMaxLifetime)
+	}
+	if cfg.DB.ConnMaxIdleTime < 0 {
+		errs.add("db conn_max_idle_time must not be negative: %d", cfg.DB.ConnMaxIdleTime)
+	}
+	if cfg.DB.StartupMaxWait < 0 {
+		errs.add("db startup_max_wait must not be negative: %d", cfg.DB.StartupMaxWait)
+	}
+	if cfg.DB.QueryTimeout <= 0 {
+		errs.add("db query_timeout must be positive: %d", cfg.DB.QueryTimeout)
+	}
+	if cfg.DB.BulkTimeout <= 0 {
+		errs.add("db bulk_timeout must be positive: %d", cfg.DB.BulkTimeout)
+	}
+
+	if len(cfg.Session.CookieSID) == 0 {
+		errs.add("session cookie_sid is not set")
+	}
+	if cfg.Session.CookieMaxAge <= 0 {
+		errs.add("session cookie_max_age must be positive: %d", cfg.Session.CookieMaxAge)
+	}
+	if cfg.Session.CleanupInterval <= 0 {
+		errs.add("session cleanup_sessions must be positive: %d", cfg.Session.CleanupInterval)
+	}
+	switch cfg.Session.Store {
+	case sessionStoreMemory, sessionStoreSQL:
+	case sessionStoreRedis:
+		if _, err := redis.ParseURL(cfg.Session.RedisURL); err != nil {
+			errs.add("session redis_url is not valid: %s", err)
+		}
+	default:
+		errs.add("session store must be memory, sql or redis: %s", cfg.Session.Store)
+	}
+	switch cfg.Session.Mode {
+	case sessionModeCookie:
+	case sessionModeJWT:
+		if _, ok := cfg.Session.JWTKeys[cfg.Session.JWTSigningKey]; !ok {
+			errs.add("session jwt_signing_key is not one of jwt_keys: %s", cfg.Session.JWTSigningKey)
+		}
+	default:
+		errs.add("session mode must be cookie or jwt: %s", cfg.Session.Mode)
+	}
+	for kid, key := range cfg.Session.JWTKeys {
+		if len(key) < minJWTKeyLength {
+			errs.add("session jwt_keys %s must be at least %d bytes", kid, minJWTKeyLength)
+		}
+	}
+	if cfg.Session.AccessTokenTTL <= 0 {
+		errs.add("session access_token_ttl must be positive: %d", cfg.Session.AccessTokenTTL)
+	}
+	if cfg.Session.RefreshTokenTTL <= 0 {
+		errs.add("session refresh_token_ttl must be positive: %d", cfg.Session.RefreshTokenTTL)
+	}
+	if len(cfg.OIDC.Issuer) != 0 {
+		if u, err := url.Parse(cfg.OIDC.Issuer); err != nil || !u.IsAbs() {
+			errs.add("oidc issuer is not a valid URL: %s", cfg.OIDC.Issuer)
+		}
+		if len(cfg.OIDC.ClientID) == 0 {
+			errs.add("oidc client_id is not set")
+		}
+		if u, err := url.Parse(cfg.OIDC.RedirectURL); err != nil || !u.IsAbs() {
+			errs.add("oidc redirect_url is not a valid URL: %s", cfg.OIDC.RedirectURL)
+		}
+	}
+	if cfg.Trash.Retention < 0 {
+		errs.add("trash retention must not be negative: %d", cfg.Trash.Retention)
+	}
+	if cfg.Trash.PurgeInterval <= 0 {
+		errs.add("trash purge_interval must be positive: %d", cfg.Trash.PurgeInterval)
+	}
+
+	return errs
+}
+
+// ConnString returns the configured DSN, or builds one from the separate
+// db settings when no DSN is given.
+func (dbConfig DBConfig) ConnString() string {
+	if len(dbConfig.DSN) != 0 {
+		return dbConfig.DSN
+	}
+
+	params := url.Values{}
+	params.Set("sslmode", dbConfig.SSLMode)
+	if len(dbConfig.SSLRootCert) != 0 {
+		params.Set("sslrootcert", dbConfig.SSLRootCert)
+	}
+	if len(dbConfig.SSLCert) != 0 {
+		params.Set("sslcert", dbConfig.SSLCert)
+	}
+	if len(dbConfig.SSLKey) != 0 {
+		params.Set("sslkey", dbConfig.SSLKey)
+	}
+
+	u := url.URL{
+		Scheme:   "postgresql",
+		User:     url.UserPassword(dbConfig.User, dbConfig.Pass),
+		Host:     fmt.Sprintf("%s:%s", dbConfig.Host, dbConfig.Port),
+		Path:     "/" + dbConfig.Name,
+		RawQuery: params.Encode(),
+	}
+	return u.String()
+}
+
+var dsnPasswordRegexp = regexp.MustCompile(`(password=)('[^']*'|\S+)`)
+
+// Redacted returns a copy of the config that is safe to print.
+func (cfg Config) Redacted() Config {
+	if len(cfg.DB.Pass) != 0 {
+		cfg.DB.Pass = redacted
+	}
+	cfg.DB.DSN = redactDSN(cfg.DB.DSN)
+	cfg.Session.RedisURL = redactDSN(cfg.Session.RedisURL)
+	if len(cfg.OIDC.ClientSecret) != 0 {
+		cfg.OIDC.ClientSecret = redacted
+	}
+	if len(cfg.Session.JWTKeys) != 0 {
+		keys := map[string]string{}
+		for kid := range cfg.Session.JWTKeys {
+			keys[kid] = redacted
+		}
+		cfg.Session.JWTKeys = keys
+	}
+	return cfg
+}
+
+// parseJWTKeys reads kid=key pairs separated by commas.
+func parseJWTKeys(value string) (map[string]string, error) {
+	keys := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		kid, key, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || len(kid) == 0 || len(key) == 0 {
+			return nil, fmt.Errorf("is not a list of kid=key pairs")
+		}
+		keys[kid] = key
+	}
+	return keys, nil
+}
+
+// dsnPasswordParams are the query parameters of a URL DSN holding secrets.
+var dsnPasswordParams = map[string]bool{"password": true, "sslpassword": true}
+
+// redactDSN hides the passwords of a URL or keyword/value DSN, in the
+// userinfo or in parameters.
+func redactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && len(u.Scheme) != 0 {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+		}
+		// Rewritten by hand to keep the order and escaping of the others
+		params := strings.Split(u.RawQuery, "&")
+		for i, param := range params {
+			if key, _, ok := strings.Cut(param, "="); ok && dsnPasswordParams[strings.ToLower(key)] {
+				params[i] = key + "=" + redacted
+			}
+		}
+		u.RawQuery = strings.Join(params, "&")
+		return u.String()
+	}
+
+	return dsnPasswordRegexp.ReplaceAllString(dsn, "${1}"+redacted)
+}
+
+func (cfg Config) Print() error {
+	b, err := yaml.Marshal(cfg.Redacted())
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(b)
+	return err
+}
@@ -1,154 +1,1023 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"strings"
 	"time"
 )
 
+var ErrRecipeNotFound = errors.New("recipe not found")
+
+// ErrVersionMismatch is returned when a recipe changed since the version the
+// client based its request on.
+var ErrVersionMismatch = errors.New("recipe version does not match")
+
 type DBManager struct {
-	db *sql.DB
+	db           *sql.DB
+	queryTimeout time.Duration
+	bulkTimeout  time.Duration
 }
 
-func InitConnection(host, user, pass, dbname, port string) (*DBManager, error) {
-	connString := fmt.Sprintf("postgresql://%s:%s@%s:%s/%s?sslmode=disable", user, pass, host, port, dbname)
-	db, err := sql.Open("postgres", connString)
+const maxConnectBackoff = 10 * time.Second
+
+// InitConnection opens the connection pool and waits until the db answers,
+// retrying for up to cfg.StartupMaxWait seconds.
+func InitConnection(ctx context.Context, cfg DBConfig) (*DBManager, error) {
+	db, err := sql.Open("postgres", cfg.ConnString())
 	if err != nil {
 		return &DBManager{}, err
 	}
 
-	return &DBManager{db}, nil
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(cfg.ConnMaxLifetime) * time.Second)
+	db.SetConnMaxIdleTime(time.Duration(cfg.ConnMaxIdleTime) * time.Second)
+
+	dbManager := &DBManager{
+		db:           db,
+		queryTimeout: time.Duration(cfg.QueryTimeout) * time.Second,
+		bulkTimeout:  time.Duration(cfg.BulkTimeout) * time.Second,
+	}
+
+	if err := dbManager.waitForDB(ctx, time.Duration(cfg.StartupMaxWait)*time.Second); err != nil {
+		db.Close()
+		return &DBManager{}, err
+	}
+
+	return dbManager, nil
 }
 
-func (dbManager *DBManager) ExecQuery(query string) (*sql.Rows, error) {
-	res, err := dbManager.db.Query(query)
-	if err != nil {
-		return nil, err
+// waitForDB pings the db until it answers, doubling the delay between
+// attempts, and gives up once maxWait has passed.
+func (dbManager *DBManager) waitForDB(ctx context.Context, maxWait time.Duration) error {
+	deadline := time.Now().Add(maxWait)
+	backoff := 500 * time.Millisecond
+
+	for attempt := 1; ; attempt++ {
+		pingCtx, cancel := dbManager.withTimeout(ctx)
+		err := dbManager.db.PingContext(pingCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("db is not reachable after %d attempts: %s", attempt, err)
+		}
+
+		logger.Warn("db is not reachable, retrying", "attempt", attempt, "retry_in", backoff.String(), "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxConnectBackoff {
+			backoff = maxConnectBackoff
+		}
+	}
+}
+
+// withTimeout bounds a db call by the configured query timeout. The returned
+// context is also cancelled when ctx is, e.g. when the client disconnects.
+func (dbManager *DBManager) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if dbManager.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
 	}
 
-	return res, nil
+	return context.WithTimeout(ctx, dbManager.queryTimeout)
 }
 
-func (dbManager *DBManager) ExecInsertRecipeQuery(name string, prep_time int, difficulty int8, vegeterian bool, createdAt time.Time) error {
-	query := `
-		INSERT INTO app.recipes (name, prep_time, difficulty, vegeterian, createdat, updatedat)
-		VALUES ($1, $2, $3, $4, $5, $6)
-	`
-	_, err := dbManager.db.Query(query, name, prep_time, difficulty, vegeterian, createdAt.Format(time.RFC3339), createdAt.Format(time.RFC3339))
+// withBulkTimeout bounds a whole import or export, which runs many
+// statements, by the configured bulk timeout instead.
+func (dbManager *DBManager) withBulkTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if dbManager.bulkTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, dbManager.bulkTimeout)
+}
+
+// logError logs a failed db call with the request ID carried by ctx and
+// returns err unchanged.
+func (dbManager *DBManager) logError(ctx context.Context, op string, err error) error {
+	if err != nil {
+		loggerFrom(ctx).Error("db call failed", "op", op, "error", err)
+	}
 	return err
 }
 
-func (dbManager *DBManager) ExecInsertRateQuery(recipeID int64, rate int8, createdAt time.Time) error {
-	query := `
-		INSERT INTO app.rates (recipeID, rate, createdat)
-		VALUES ($1, $2, $3)
-	`
-	_, err := dbManager.db.Query(query, recipeID, rate, createdAt.Format(time.RFC3339))
+func (dbManager *DBManager) Close() error {
+	return dbManager.db.Close()
+}
+
+func (dbManager *DBManager) Ping(ctx context.Context) error {
+	ctx, cancel := dbManager.withTimeout(ctx)
+	defer cancel()
+
+	return dbManager.logError(ctx, "ping", dbManager.db.PingContext(ctx))
+}
+
+// SchemaVersion returns the version of the latest migration applied to the db.
+func (dbManager *DBManager) SchemaVersion(ctx context.Context) (int, error) {
+	version := 0
+	err := dbManager.QueryRow(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations;", nil, &version)
+	return version, dbManager.logError(ctx, "get schema version", err)
+}
+
+// ExecQuery runs a statement that returns no rows.
+func (dbManager *DBManager) ExecQuery(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	ctx, cancel := dbManager.withTimeout(ctx)
+	defer cancel()
+
+	res, err := dbManager.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, dbManager.logError(ctx, "exec query", err)
+	}
+
+	return res.RowsAffected()
+}
+
+// QueryRow runs a query returning a single row and scans it into dest.
+// It returns sql.ErrNoRows when the query has no results.
+func (dbManager *DBManager) QueryRow(ctx context.Context, query string, args []interface{}, dest ...interface{}) error {
+	ctx, cancel := dbManager.withTimeout(ctx)
+	defer cancel()
+
+	return dbManager.db.QueryRowContext(ctx, query, args...).Scan(dest...)
+}
+
+const insertRecipeQuery = `
+	INSERT INTO app.recipes (name, prep_time, difficulty, vegeterian, createdat, updatedat)
+	VALUES ($1, $2, $3, $4, $5, $6)
+`
+
+func (dbManager *DBManager) ExecInsertRecipeQuery(ctx context.Context, name string, prep_time int, difficulty int8, vegeterian bool, createdAt time.Time) error {
+	_, err := dbManager.ExecQuery(ctx, insertRecipeQuery, name, prep_time, difficulty, vegeterian, createdAt.Format(time.RFC3339), createdAt.Format(time.RFC3339))
 	return err
 }
 
-func (dbManager *DBManager) ExecUpdateQuery() error {
+// ImportRecipes inserts the valid rows in one transaction and reports the
+// invalid ones. When atomic is set any invalid row rolls the whole import
+// back and ErrImportRejected is returned.
+func (dbManager *DBManager) ImportRecipes(ctx context.Context, rows RecipeRows, atomic bool, createdAt time.Time) (ImportResult, error) {
+	ctx, cancel := dbManager.withBulkTimeout(ctx)
+	defer cancel()
+
+	result := ImportResult{Errors: []ImportRowError{}}
+	err := dbManager.runTx(ctx, "import recipes", func(tx *sql.Tx) error {
+		stmt, err := tx.PrepareContext(ctx, insertRecipeQuery)
+		if err != nil {
+			return dbManager.logError(ctx, "import recipes", err)
+		}
+		defer stmt.Close()
+
+		for {
+			fields, err := rows.Next()
+			if err == io.EOF {
+				break
+			}
+			var rowErr *ImportRowError
+			if errors.As(err, &rowErr) {
+				result.Failed++
+				result.Errors = append(result.Errors, *rowErr)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			// Keep validating the remaining rows to report all errors at once
+			if atomic && result.Failed > 0 {
+				continue
+			}
+
+			_, err = stmt.ExecContext(ctx, fields.Name, fields.PrepTime, fields.Difficulty, fields.Vegeterian,
+				createdAt.Format(time.RFC3339), createdAt.Format(time.RFC3339))
+			if err != nil {
+				return dbManager.logError(ctx, "import recipes", err)
+			}
+			result.Imported++
+		}
+
+		if atomic && result.Failed > 0 {
+			return ErrImportRejected
+		}
+		return nil
+	})
+	if err != nil {
+		result.Imported = 0
+	}
+
+	return result, err
+}
+
+// ExecInsertRateQuery inserts a rate of a recipe that is not in the trash,
+// returning ErrRecipeNotFound otherwise, and bumps the recipe version since
+// the rating is part of the recipe representation.
+func (dbManager *DBManager) ExecInsertRateQuery(ctx context.Context, recipeID int64, rate int8, createdAt time.Time) error {
+	return dbManager.WithTx(ctx, "insert rate", func(tx *sql.Tx) error {
+		_, err := dbManager.lockRecipe(ctx, tx, recipeID, nil, false)
+		if err == ErrRecipeNotFound {
+			return err
+		}
+		if err != nil {
+			return dbManager.logError(ctx, "insert rate", err)
+		}
+
+		query := `
+			INSERT INTO app.rates (recipeID, rate, createdat)
+			VALUES ($1, $2, $3)
+		`
+		if _, err := tx.ExecContext(ctx, query, recipeID, rate, createdAt.Format(time.RFC3339)); err != nil {
+			return dbManager.logError(ctx, "insert rate", err)
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE app.recipes SET version = version + 1 WHERE id = $1;", recipeID)
+		return dbManager.logError(ctx, "insert rate", err)
+	})
+}
+
+// WithTx runs fn in a transaction, committing it when fn succeeds and
+// rolling it back otherwise.
+func (dbManager *DBManager) WithTx(ctx context.Context, op string, fn func(tx *sql.Tx) error) error {
+	ctx, cancel := dbManager.withTimeout(ctx)
+	defer cancel()
+
+	return dbManager.runTx(ctx, op, fn)
+}
+
+// runTx is WithTx without the query timeout, ctx must already be bounded.
+func (dbManager *DBManager) runTx(ctx context.Context, op string, fn func(tx *sql.Tx) error) error {
+	tx, err := dbManager.db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbManager.logError(ctx, op, err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return dbManager.logError(ctx, op, tx.Commit())
+}
+
+// recipeChildTables lists the tables referencing app.recipes by recipeID.
+// Their rows are deleted together with the recipe.
+var recipeChildTables = []string{
+	"app.rates",
+	"app.recipe_revisions",
+}
+
+// lockRecipe locks the row of a recipe until the end of tx and checks its
+// version against match. Recipes in the trash are only found with
+// withDeleted set.
+func (dbManager *DBManager) lockRecipe(ctx context.Context, tx *sql.Tx, recipeID int64, match VersionMatch, withDeleted bool) (int, error) {
+	query := "SELECT version FROM app.recipes WHERE id = $1 AND deleted_at IS NULL FOR UPDATE;"
+	if withDeleted {
+		query = "SELECT version FROM app.recipes WHERE id = $1 FOR UPDATE;"
+	}
+
+	var version int
+	err := tx.QueryRowContext(ctx, query, recipeID).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, ErrRecipeNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !match.Matches(version) {
+		return 0, ErrVersionMismatch
+	}
+
+	return version, nil
+}
+
+// deleteRecipes permanently deletes the recipes matched by whereClause and
+// their child rows, returning the number of deleted recipes.
+func (dbManager *DBManager) deleteRecipes(ctx context.Context, tx *sql.Tx, whereClause string, args ...interface{}) (int64, error) {
+	for _, table := range recipeChildTables {
+		query := fmt.Sprintf("DELETE FROM %s WHERE recipeid IN (SELECT id FROM app.recipes %s);", table, whereClause)
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return 0, err
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM app.recipes %s;", whereClause), args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// DeleteRecipe permanently deletes a recipe, in the trash or not, and its
+// child rows in one transaction. It returns ErrRecipeNotFound when the recipe
+// does not exist and ErrVersionMismatch when its version is not in match.
+func (dbManager *DBManager) DeleteRecipe(ctx context.Context, recipeID int64, match VersionMatch) error {
+	return dbManager.WithTx(ctx, "delete recipe", func(tx *sql.Tx) error {
+		_, err := dbManager.lockRecipe(ctx, tx, recipeID, match, true)
+		if err == ErrRecipeNotFound || err == ErrVersionMismatch {
+			return err
+		}
+		if err != nil {
+			return dbManager.logError(ctx, "delete recipe", err)
+		}
+
+		_, err = dbManager.deleteRecipes(ctx, tx, "WHERE id = $1", recipeID)
+		return dbManager.logError(ctx, "delete recipe", err)
+	})
+}
+
+// PurgeDeletedRecipes permanently deletes the recipes moved to the trash
+// before t and returns how many were deleted.
+func (dbManager *DBManager) PurgeDeletedRecipes(ctx context.Context, t time.Time) (int64, error) {
+	var n int64
+	err := dbManager.WithTx(ctx, "purge deleted recipes", func(tx *sql.Tx) error {
+		var err error
+		n, err = dbManager.deleteRecipes(ctx, tx, "WHERE deleted_at < $1", t.Format(time.RFC3339))
+		return dbManager.logError(ctx, "purge deleted recipes", err)
+	})
+
+	return n, err
+}
+
+// SoftDeleteRecipe moves a recipe to the trash. It returns ErrRecipeNotFound
+// when the recipe does not exist or is already in the trash and
+// ErrVersionMismatch when its version is not in match.
+func (dbManager *DBManager) SoftDeleteRecipe(ctx context.Context, recipeID int64, deletedAt time.Time, match VersionMatch) error {
+	return dbManager.WithTx(ctx, "soft delete recipe", func(tx *sql.Tx) error {
+		_, err := dbManager.lockRecipe(ctx, tx, recipeID, match, false)
+		if err == ErrRecipeNotFound || err == ErrVersionMismatch {
+			return err
+		}
+		if err != nil {
+			return dbManager.logError(ctx, "soft delete recipe", err)
+		}
+
+		query := "UPDATE app.recipes SET deleted_at = $1 WHERE id = $2;"
+		_, err = tx.ExecContext(ctx, query, deletedAt.Format(time.RFC3339), recipeID)
+		return dbManager.logError(ctx, "soft delete recipe", err)
+	})
+}
+
+// RestoreRecipe takes a recipe out of the trash. It returns
+// ErrRecipeNotFound when the recipe is not in the trash.
+func (dbManager *DBManager) RestoreRecipe(ctx context.Context, recipeID int64) error {
+	query := "UPDATE app.recipes SET deleted_at = NULL WHERE id = $1 AND deleted_at IS NOT NULL;"
+	n, err := dbManager.ExecQuery(ctx, query, recipeID)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrRecipeNotFound
+	}
+
 	return nil
 }
 
-func (dbManager *DBManager) ExecDeleteQuery(table, idKey, idVal string) error {
-	query := fmt.Sprintf(`
-		DELETE FROM %s
-		WHERE %s = $1
-	`, table, idKey)
-	_, err := dbManager.db.Query(query, idVal)
+// UpdateRecipe applies change to a recipe not in the trash and records it
+// as a new revision by userID (0 when unknown), in one transaction. It
+// returns ErrRecipeNotFound when the recipe does not exist, ErrVersionMismatch
+// when its version is not in match and the error of change if any.
+func (dbManager *DBManager) UpdateRecipe(ctx context.Context, recipeID int64, change RecipeChange, userID int64, match VersionMatch) (RecipeRevision, error) {
+	revision := RecipeRevision{
+		RecipeID:  recipeID,
+		UserID:    userID,
+		CreatedAt: time.Now().UTC(),
+	}
 
-	return err
+	err := dbManager.WithTx(ctx, "update recipe", func(tx *sql.Tx) error {
+		_, err := dbManager.lockRecipe(ctx, tx, recipeID, match, false)
+		if err == ErrRecipeNotFound || err == ErrVersionMismatch {
+			return err
+		}
+		if err != nil {
+			return dbManager.logError(ctx, "update recipe", err)
+		}
+
+		query := "SELECT name, prep_time, difficulty, vegeterian FROM app.recipes WHERE id = $1;"
+		old := &revision.Old
+		err = tx.QueryRowContext(ctx, query, recipeID).Scan(&old.Name, &old.PrepTime, &old.Difficulty, &old.Vegeterian)
+		if err != nil {
+			return dbManager.logError(ctx, "update recipe", err)
+		}
+
+		revision.New, err = change(revision.Old)
+		if err != nil {
+			return err
+		}
+
+		query = `
+			UPDATE app.recipes
+			SET name = $1, prep_time = $2, difficulty = $3, vegeterian = $4, updatedat = $5, version = version + 1
+			WHERE id = $6;
+		`
+		_, err = tx.ExecContext(ctx, query, revision.New.Name, revision.New.PrepTime, revision.New.Difficulty, revision.New.Vegeterian,
+			revision.CreatedAt.Format(time.RFC3339), recipeID)
+		if err != nil {
+			return dbManager.logError(ctx, "update recipe", err)
+		}
+
+		// The recipe row lock serializes revisions of the same recipe
+		query = "SELECT COALESCE(MAX(revision), 0) + 1 FROM app.recipe_revisions WHERE recipeid = $1;"
+		if err := tx.QueryRowContext(ctx, query, recipeID).Scan(&revision.Revision); err != nil {
+			return dbManager.logError(ctx, "update recipe", err)
+		}
+
+		oldValues, err := json.Marshal(revision.Old)
+		if err != nil {
+			return err
+		}
+		newValues, err := json.Marshal(revision.New)
+		if err != nil {
+			return err
+		}
+
+		var user sql.NullInt64
+		if userID > 0 {
+			user = sql.NullInt64{Int64: userID, Valid: true}
+		}
+		query = `
+			INSERT INTO app.recipe_revisions (recipeID, revision, userID, old_values, new_values, createdat)
+			VALUES ($1, $2, $3, $4, $5, $6);
+		`
+		_, err = tx.ExecContext(ctx, query, recipeID, revision.Revision, user, oldValues, newValues, revision.CreatedAt.Format(time.RFC3339))
+		return dbManager.logError(ctx, "update recipe", err)
+	})
+
+	return revision, err
+}
+
+// GetRecipeRevisions lists the revisions of a recipe, oldest first. Like
+// the recipe itself, they are not found once it is in the trash.
+func (dbManager *DBManager) GetRecipeRevisions(ctx context.Context, recipeID int64) ([]RecipeRevision, error) {
+	ctx, cancel := dbManager.withTimeout(ctx)
+	defer cancel()
+
+	exists := false
+	err := dbManager.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM app.recipes WHERE id = $1 AND deleted_at IS NULL);", recipeID).Scan(&exists)
+	if err != nil {
+		return nil, dbManager.logError(ctx, "get recipe revisions", err)
+	}
+	if !exists {
+		return nil, ErrRecipeNotFound
+	}
+
+	query := `
+		SELECT revision, recipeID, COALESCE(userID, 0), old_values, new_values, createdat
+		FROM app.recipe_revisions
+		WHERE recipeID = $1
+		ORDER BY revision;
+	`
+	rows, err := dbManager.db.QueryContext(ctx, query, recipeID)
+	if err != nil {
+		return nil, dbManager.logError(ctx, "get recipe revisions", err)
+	}
+	defer rows.Close()
+
+	revisions := []RecipeRevision{}
+	for rows.Next() {
+		revision := RecipeRevision{}
+		var oldValues, newValues []byte
+		err = rows.Scan(&revision.Revision, &revision.RecipeID, &revision.UserID, &oldValues, &newValues, &revision.CreatedAt)
+		if err != nil {
+			return nil, dbManager.logError(ctx, "get recipe revisions", err)
+		}
+		if err := json.Unmarshal(oldValues, &revision.Old); err != nil {
+			return nil, dbManager.logError(ctx, "get recipe revisions", err)
+		}
+		if err := json.Unmarshal(newValues, &revision.New); err != nil {
+			return nil, dbManager.logError(ctx, "get recipe revisions", err)
+		}
+
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, dbManager.logError(ctx, "get recipe revisions", rows.Err())
+}
+
+// GetDeletedRecipes lists the recipes in the trash, most recently deleted first.
+func (dbManager *DBManager) GetDeletedRecipes(ctx context.Context) ([]DeletedRecipe, error) {
+	ctx, cancel := dbManager.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT a.id, a.name, a.prep_time, a.difficulty, a.vegeterian, a.createdat, a.updatedat, COALESCE(AVG(b.rate), 0) AS rating, COUNT(b.rate) AS ratings, a.version, a.deleted_at
+		FROM app.recipes a
+		LEFT OUTER JOIN app.rates b
+		ON a.id = b.recipeID
+		WHERE a.deleted_at IS NOT NULL
+		GROUP BY 1, 2, 3, 4, 5
+		ORDER BY a.deleted_at DESC;
+	`
+	rows, err := dbManager.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, dbManager.logError(ctx, "get deleted recipes", err)
+	}
+	defer rows.Close()
+
+	recipes := []DeletedRecipe{}
+	for rows.Next() {
+		recipe := DeletedRecipe{}
+		err = rows.Scan(&recipe.ID, &recipe.Name, &recipe.PrepTime, &recipe.Difficulty, &recipe.Vegeterian, &recipe.CreatedAt, &recipe.UpdatedAt, &recipe.Rating, &recipe.RatingCount, &recipe.Version, &recipe.DeletedAt)
+		if err != nil {
+			return nil, dbManager.logError(ctx, "get deleted recipes", err)
+		}
+
+		recipes = append(recipes, recipe)
+	}
+
+	return recipes, dbManager.logError(ctx, "get deleted recipes", rows.Err())
 }
 
 func (dbManager *DBManager) EscapeQuotes(s string) string {
 	return strings.Replace(s, "'", "''", -1)
 }
 
-func (dbManager *DBManager) InsertUser(username, fullName, passwordHash string) error {
+func (dbManager *DBManager) InsertUser(ctx context.Context, username, fullName, passwordHash string) error {
 	createdAt := time.Now().UTC().Format(time.RFC3339)
 	query := `
 		INSERT INTO app.users (username, fullName, passwordHash, createdAt)
 		VALUES ($1, $2, $3, $4)
 	`
-	_, err := dbManager.db.Query(query, username, fullName, passwordHash, createdAt)
+	_, err := dbManager.ExecQuery(ctx, query, username, fullName, passwordHash, createdAt)
 	return err
 }
 
-func (dbManager *DBManager) InsertUserSession(session Session) error {
+func (dbManager *DBManager) InsertUserSession(ctx context.Context, session Session) error {
 	query := `
-		INSERT INTO app.usersessions (sessionKey, userID, LoginTime)
-		VALUES ($1, $2, $3)
+		INSERT INTO app.usersessions (sessionKey, userID, LoginTime, lastSeenAt, userAgent, ipAddress)
+		VALUES ($1, $2, $3, $4, $5, $6)
 	`
-	_, err := dbManager.db.Query(query, session.SessionKey, session.User.ID, session.LoginTime.Format(time.RFC3339))
+	_, err := dbManager.ExecQuery(ctx, query, session.SessionKey, session.User.ID, session.LoginTime.Format(time.RFC3339), session.LastSeen.Format(time.RFC3339),
+		session.UserAgent, session.IP)
 	return err
 }
 
-func (dbManager *DBManager) DeleteUserSessionByID(sessionKey string) error {
+func (dbManager *DBManager) DeleteUserSessionByID(ctx context.Context, sessionKey string) error {
 	query := "DELETE FROM app.usersessions WHERE sessionKey = $1;"
-	_, err := dbManager.db.Query(query, sessionKey)
+	_, err := dbManager.ExecQuery(ctx, query, sessionKey)
+	return err
+}
+
+// DeleteUserSessionsByUserID deletes every session of a user.
+func (dbManager *DBManager) DeleteUserSessionsByUserID(ctx context.Context, userID int64) error {
+	query := "DELETE FROM app.usersessions WHERE userID = $1;"
+	_, err := dbManager.ExecQuery(ctx, query, userID)
 	return err
 }
 
-func (dbManager *DBManager) DeleteExpiredUserSessions(t time.Time) error {
-	query := "DELETE FROM app.usersessions WHERE LoginTime < $1;"
-	_, err := dbManager.db.Query(query, t.Format(time.RFC3339))
+// CountUserSessions counts the sessions seen after t.
+func (dbManager *DBManager) CountUserSessions(ctx context.Context, t time.Time) (int, error) {
+	count := 0
+	err := dbManager.QueryRow(ctx, "SELECT COUNT(*) FROM app.usersessions WHERE lastSeenAt > $1;", []interface{}{t.Format(time.RFC3339)}, &count)
+	return count, dbManager.logError(ctx, "count user sessions", err)
+}
+
+// DeleteExpiredUserSessions deletes the sessions not seen since t.
+func (dbManager *DBManager) DeleteExpiredUserSessions(ctx context.Context, t time.Time) error {
+	query := "DELETE FROM app.usersessions WHERE lastSeenAt < $1;"
+	_, err := dbManager.ExecQuery(ctx, query, t.Format(time.RFC3339))
 	return err
 }
 
-func (dbManagager *DBManager) GetUserActiveSessions(sessionKey string, maxLifeTime int64) (Session, error) {
+// TouchUserSession returns the session of an enabled user seen after since,
+// and records it as seen at now.
+func (dbManager *DBManager) TouchUserSession(ctx context.Context, sessionKey string, since, now time.Time) (Session, error) {
 	session := Session{}
-	query := `SELECT a.id, a.username, a.fullname, b.sessionkey, b.LoginTime
+	query := `UPDATE app.usersessions b SET lastSeenAt = $3
+						FROM app.users a
+						WHERE a.id = b.userid
+							AND a.isdisabled = FALSE
+							AND b.sessionkey = $1
+							AND b.lastSeenAt > $2
+						RETURNING a.id, a.username, a.fullname, a.isadmin, b.sessionkey, b.LoginTime, b.lastSeenAt, b.userAgent, b.ipAddress;
+	`
+	err := dbManager.QueryRow(ctx, query, []interface{}{sessionKey, since.Format(time.RFC3339), now.Format(time.RFC3339)},
+		&session.User.ID, &session.User.Username, &session.User.Fullname, &session.User.IsAdmin, &session.SessionKey, &session.LoginTime, &session.LastSeen,
+		&session.UserAgent, &session.IP)
+	if err == sql.ErrNoRows {
+		return session, ErrSessionNotFound
+	}
+	if err != nil {
+		return session, dbManager.logError(ctx, "touch user session", err)
+	}
+
+	return session, nil
+}
+
+// GetUserSessions returns the sessions of a user seen after since, most
+// recently seen first.
+func (dbManager *DBManager) GetUserSessions(ctx context.Context, userID int64, since time.Time) ([]Session, error) {
+	ctx, cancel := dbManager.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT a.id, a.username, a.fullname, a.isadmin, b.sessionkey, b.LoginTime, b.lastSeenAt, b.userAgent, b.ipAddress
 						FROM app.users a
 						INNER JOIN app.usersessions b
 						ON a.id = b.userid
-						WHERE a.isdisabled = FALSE
-							AND b.sessionkey = $1
-							AND b.LoginTime + $2 * interval '1 second' > CURRENT_TIMESTAMP;
+						WHERE a.id = $1
+							AND b.lastSeenAt > $2
+						ORDER BY b.lastSeenAt DESC;
 	`
-	res, err := dbManagager.db.Query(query, sessionKey, maxLifeTime)
+	rows, err := dbManager.db.QueryContext(ctx, query, userID, since.Format(time.RFC3339))
 	if err != nil {
-		return session, err
+		return nil, dbManager.logError(ctx, "get user sessions", err)
 	}
+	defer rows.Close()
 
-	if res.Next() {
-		res.Scan(&session.User.ID, &session.User.Username, &session.User.Fullname, &session.SessionKey, &session.LoginTime)
-	} else {
-		return session, fmt.Errorf("could not find active session for token: %s", sessionKey)
+	sessions := []Session{}
+	for rows.Next() {
+		session := Session{}
+		err = rows.Scan(&session.User.ID, &session.User.Username, &session.User.Fullname, &session.User.IsAdmin, &session.SessionKey, &session.LoginTime, &session.LastSeen,
+			&session.UserAgent, &session.IP)
+		if err != nil {
+			return nil, dbManager.logError(ctx, "get user sessions", err)
+		}
+
+		sessions = append(sessions, session)
 	}
 
-	return session, nil
+	return sessions, dbManager.logError(ctx, "get user sessions", rows.Err())
 }
 
-func (dbManager *DBManager) GetUser(username string) (User, error) {
+func (dbManager *DBManager) GetUser(ctx context.Context, username string) (User, error) {
 	user := User{}
-	query := `SELECT id, username, fullname, passwordHash
+	query := `SELECT id, username, fullname, passwordHash, isadmin
 						FROM app.users
 						WHERE username = $1
 							AND isdisabled = FALSE;
 	`
-	res, err := dbManager.db.Query(query, username)
+	err := dbManager.QueryRow(ctx, query, []interface{}{username}, &user.ID, &user.Username, &user.Fullname, &user.PasswordHash, &user.IsAdmin)
+	if err == sql.ErrNoRows {
+		return user, fmt.Errorf("user not found: %s", username)
+	}
 	if err != nil {
-		return user, err
+		return user, dbManager.logError(ctx, "get user", err)
 	}
 
-	if res.Next() {
-		res.Scan(&user.ID, &user.Username, &user.Fullname, &user.PasswordHash)
-	} else {
-		return user, fmt.Errorf("user not found: %s", username)
+	return user, nil
+}
+
+// GetUserByID returns an enabled user, or ErrUserDisabled when the user is
+// disabled or does not exist anymore.
+func (dbManager *DBManager) GetUserByID(ctx context.Context, userID int64) (User, error) {
+	user := User{}
+	query := `SELECT id, username, fullname, isadmin
+						FROM app.users
+						WHERE id = $1
+							AND isdisabled = FALSE;
+	`
+	err := dbManager.QueryRow(ctx, query, []interface{}{userID}, &user.ID, &user.Username, &user.Fullname, &user.IsAdmin)
+	if err == sql.ErrNoRows {
+		return user, ErrUserDisabled
+	}
+	if err != nil {
+		return user, dbManager.logError(ctx, "get user by id", err)
 	}
 
 	return user, nil
 }
 
-func (dbManager *DBManager) GetRecipes(recipeID int64, items, page int) ([]Recipe, error) {
-	whereClause := ""
+func (dbManager *DBManager) InsertAPIKey(ctx context.Context, apiKey APIKey, keyHash string) (int64, error) {
+	var id int64
+	query := `
+		INSERT INTO app.api_keys (userID, name, prefix, keyHash, scopes, createdat)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id;
+	`
+	err := dbManager.QueryRow(ctx, query, []interface{}{apiKey.UserID, apiKey.Name, apiKey.Prefix, keyHash, strings.Join(apiKey.Scopes, " "), apiKey.CreatedAt.Format(time.RFC3339)}, &id)
+	return id, dbManager.logError(ctx, "insert api key", err)
+}
+
+// GetAPIKeys returns the unrevoked keys of a user, newest first.
+func (dbManager *DBManager) GetAPIKeys(ctx context.Context, userID int64) ([]APIKey, error) {
+	ctx, cancel := dbManager.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT id, userID, name, prefix, scopes, createdat, lastUsedAt
+						FROM app.api_keys
+						WHERE userID = $1
+							AND revokedAt IS NULL
+						ORDER BY createdat DESC, id DESC;
+	`
+	rows, err := dbManager.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, dbManager.logError(ctx, "get api keys", err)
+	}
+	defer rows.Close()
+
+	apiKeys := []APIKey{}
+	for rows.Next() {
+		apiKey := APIKey{}
+		scopes := ""
+		err = rows.Scan(&apiKey.ID, &apiKey.UserID, &apiKey.Name, &apiKey.Prefix, &scopes, &apiKey.CreatedAt, &apiKey.LastUsedAt)
+		if err != nil {
+			return nil, dbManager.logError(ctx, "get api keys", err)
+		}
+		apiKey.Scopes = strings.Fields(scopes)
+
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	return apiKeys, dbManager.logError(ctx, "get api keys", rows.Err())
+}
+
+// RevokeAPIKey revokes a key of the user. It returns ErrAPIKeyNotFound when
+// the user has no such unrevoked key.
+func (dbManager *DBManager) RevokeAPIKey(ctx context.Context, userID, id int64, t time.Time) error {
+	query := `
+		UPDATE app.api_keys SET revokedAt = $3
+		WHERE id = $1
+			AND userID = $2
+			AND revokedAt IS NULL;
+	`
+	affected, err := dbManager.ExecQuery(ctx, query, id, userID, t.Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrAPIKeyNotFound
+	}
+
+	return nil
+}
+
+// GetAPIKeySession returns a session of the enabled user owning the
+// unrevoked key with keyHash, and records the key as used at t.
+func (dbManager *DBManager) GetAPIKeySession(ctx context.Context, keyHash string, t time.Time) (Session, error) {
+	session := Session{}
+	scopes := ""
+	query := `UPDATE app.api_keys a SET lastUsedAt = $2
+						FROM app.users b
+						WHERE a.userID = b.id
+							AND a.keyHash = $1
+							AND a.revokedAt IS NULL
+							AND b.isdisabled = FALSE
+						RETURNING b.id, b.username, b.fullname, b.isadmin, a.id, a.scopes;
+	`
+	err := dbManager.QueryRow(ctx, query, []interface{}{keyHash, t.Format(time.RFC3339)},
+		&session.User.ID, &session.User.Username, &session.User.Fullname, &session.User.IsAdmin, &session.APIKeyID, &scopes)
+	if err == sql.ErrNoRows {
+		return session, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return session, dbManager.logError(ctx, "get api key session", err)
+	}
+	session.Scopes = strings.Fields(scopes)
+	session.LoginTime = t
+
+	return session, nil
+}
+
+func (dbManager *DBManager) InsertRefreshToken(ctx context.Context, token RefreshToken, tokenHash string) error {
+	query := `
+		INSERT INTO app.refresh_tokens (userID, familyID, tokenHash, createdat, expiresAt, userAgent, ipAddress)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	_, err := dbManager.ExecQuery(ctx, query, token.UserID, token.FamilyID, tokenHash, token.CreatedAt.Format(time.RFC3339), token.ExpiresAt.Format(time.RFC3339),
+		token.UserAgent, token.IP)
+	return err
+}
+
+// RotateRefreshToken uses up the refresh token with tokenHash and inserts
+// next, of the same family and client, in its place. It returns the user and
+// the family of the token. A token that was already used or revoked revokes
+// its whole family and ErrRefreshTokenReused is returned.
+func (dbManager *DBManager) RotateRefreshToken(ctx context.Context, tokenHash string, next RefreshToken, nextHash string) (User, string, error) {
+	user := User{}
+	reused := false
+	err := dbManager.WithTx(ctx, "rotate refresh token", func(tx *sql.Tx) error {
+		var id int64
+		var usedAt, revokedAt *time.Time
+		var expiresAt time.Time
+		query := `SELECT a.id, a.familyID, a.expiresAt, a.usedAt, a.revokedAt, a.userAgent, a.ipAddress, b.id, b.username, b.fullname, b.isadmin
+							FROM app.refresh_tokens a
+							INNER JOIN app.users b
+							ON a.userID = b.id
+							WHERE a.tokenHash = $1
+								AND b.isdisabled = FALSE
+							FOR UPDATE OF a;
+		`
+		err := tx.QueryRowContext(ctx, query, tokenHash).Scan(&id, &next.FamilyID, &expiresAt, &usedAt, &revokedAt, &next.UserAgent, &next.IP, &user.ID, &user.Username, &user.Fullname, &user.IsAdmin)
+		if err == sql.ErrNoRows {
+			return ErrRefreshTokenNotValid
+		}
+		if err != nil {
+			return dbManager.logError(ctx, "rotate refresh token", err)
+		}
+		if usedAt != nil || revokedAt != nil {
+			// Committed below, the error is returned once the family is revoked
+			reused = true
+			_, err = tx.ExecContext(ctx, "UPDATE app.refresh_tokens SET revokedAt = $2 WHERE familyID = $1 AND revokedAt IS NULL;",
+				next.FamilyID, next.CreatedAt.Format(time.RFC3339))
+			return dbManager.logError(ctx, "revoke refresh token family", err)
+		}
+		if !expiresAt.After(next.CreatedAt) {
+			return ErrRefreshTokenNotValid
+		}
+
+		if _, err := tx.ExecContext(ctx, "UPDATE app.refresh_tokens SET usedAt = $2 WHERE id = $1;", id, next.CreatedAt.Format(time.RFC3339)); err != nil {
+			return dbManager.logError(ctx, "rotate refresh token", err)
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO app.refresh_tokens (userID, familyID, tokenHash, createdat, expiresAt, userAgent, ipAddress)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`, user.ID, next.FamilyID, nextHash, next.CreatedAt.Format(time.RFC3339), next.ExpiresAt.Format(time.RFC3339), next.UserAgent, next.IP)
+		return dbManager.logError(ctx, "rotate refresh token", err)
+	})
+	if err == nil && reused {
+		err = ErrRefreshTokenReused
+	}
+
+	return user, next.FamilyID, err
+}
+
+// RevokeRefreshTokenFamily revokes the refresh token with tokenHash and
+// every other token of its family.
+func (dbManager *DBManager) RevokeRefreshTokenFamily(ctx context.Context, tokenHash string, t time.Time) error {
+	query := `
+		UPDATE app.refresh_tokens SET revokedAt = $2
+		WHERE familyID = (SELECT familyID FROM app.refresh_tokens WHERE tokenHash = $1)
+			AND revokedAt IS NULL;
+	`
+	affected, err := dbManager.ExecQuery(ctx, query, tokenHash, t.Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrRefreshTokenNotValid
+	}
+
+	return nil
+}
+
+// GetRefreshTokenFamilies returns the JWT sessions of a user as sessions
+// identified by their refresh token family, most recently refreshed first.
+// Families whose tokens are all used, revoked or expired at t are left out.
+func (dbManager *DBManager) GetRefreshTokenFamilies(ctx context.Context, userID int64, t time.Time) ([]Session, error) {
+	ctx, cancel := dbManager.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT familyID, MIN(createdat), MAX(createdat), MAX(userAgent), MAX(ipAddress)
+						FROM app.refresh_tokens
+						WHERE userID = $1
+						GROUP BY familyID
+						HAVING BOOL_OR(usedAt IS NULL AND revokedAt IS NULL AND expiresAt > $2)
+						ORDER BY MAX(createdat) DESC;
+	`
+	rows, err := dbManager.db.QueryContext(ctx, query, userID, t.Format(time.RFC3339))
+	if err != nil {
+		return nil, dbManager.logError(ctx, "get refresh token families", err)
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session := Session{User: User{ID: userID}}
+		err = rows.Scan(&session.FamilyID, &session.LoginTime, &session.LastSeen, &session.UserAgent, &session.IP)
+		if err != nil {
+			return nil, dbManager.logError(ctx, "get refresh token families", err)
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, dbManager.logError(ctx, "get refresh token families", rows.Err())
+}
+
+// RevokeUserRefreshTokenFamily revokes the refresh tokens of a family of the
+// user, ending that JWT session once its access tokens expire. It returns
+// ErrSessionNotFound when the user has no such unrevoked family.
+func (dbManager *DBManager) RevokeUserRefreshTokenFamily(ctx context.Context, userID int64, familyID string, t time.Time) error {
+	query := "UPDATE app.refresh_tokens SET revokedAt = $3 WHERE userID = $1 AND familyID = $2 AND revokedAt IS NULL;"
+	affected, err := dbManager.ExecQuery(ctx, query, userID, familyID, t.Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrSessionNotFound
+	}
+
+	return nil
+}
+
+// RevokeUserRefreshTokens revokes every refresh token of a user, ending
+// their JWT sessions once their access tokens expire.
+func (dbManager *DBManager) RevokeUserRefreshTokens(ctx context.Context, userID int64, t time.Time) error {
+	query := "UPDATE app.refresh_tokens SET revokedAt = $2 WHERE userID = $1 AND revokedAt IS NULL;"
+	_, err := dbManager.ExecQuery(ctx, query, userID, t.Format(time.RFC3339))
+	return err
+}
+
+func (dbManager *DBManager) DeleteExpiredRefreshTokens(ctx context.Context, t time.Time) error {
+	query := "DELETE FROM app.refresh_tokens WHERE expiresAt < $1;"
+	_, err := dbManager.ExecQuery(ctx, query, t.Format(time.RFC3339))
+	return err
+}
+
+// GetIdentityUser returns the user linked to an OIDC identity. A user is
+// created and linked when there is none, named by the first of usernames
+// that is free.
+func (dbManager *DBManager) GetIdentityUser(ctx context.Context, identity Identity, usernames []string, fullName string) (User, error) {
+	user := User{}
+	err := dbManager.WithTx(ctx, "get identity user", func(tx *sql.Tx) error {
+		isDisabled := false
+		query := `SELECT b.id, b.username, b.fullname, b.isadmin, b.isdisabled
+							FROM app.user_identities a
+							INNER JOIN app.users b
+							ON a.userID = b.id
+							WHERE a.issuer = $1
+								AND a.subject = $2;
+		`
+		err := tx.QueryRowContext(ctx, query, identity.Issuer, identity.Subject).Scan(&user.ID, &user.Username, &user.Fullname, &user.IsAdmin, &isDisabled)
+		if err == nil && isDisabled {
+			return ErrUserDisabled
+		}
+		if err == nil {
+			return nil
+		}
+		if err != sql.ErrNoRows {
+			return dbManager.logError(ctx, "get identity user", err)
+		}
+
+		for _, username := range usernames {
+			taken := false
+			err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM app.users WHERE username = $1);", username).Scan(&taken)
+			if err != nil {
+				return dbManager.logError(ctx, "get identity user", err)
+			}
+			if !taken {
+				user.Username = username
+				break
+			}
+		}
+		if len(user.Username) == 0 {
+			return fmt.Errorf("usernames are taken: %s", strings.Join(usernames, ", "))
+		}
+
+		createdAt := time.Now().UTC().Format(time.RFC3339)
+		user.Fullname = fullName
+		query = `
+			INSERT INTO app.users (username, fullName, passwordHash, createdAt)
+			VALUES ($1, $2, '', $3)
+			RETURNING id;
+		`
+		if err := tx.QueryRowContext(ctx, query, user.Username, user.Fullname, createdAt).Scan(&user.ID); err != nil {
+			return dbManager.logError(ctx, "create identity user", err)
+		}
+
+		query = `
+			INSERT INTO app.user_identities (userID, issuer, subject, createdat)
+			VALUES ($1, $2, $3, $4)
+		`
+		_, err = tx.ExecContext(ctx, query, user.ID, identity.Issuer, identity.Subject, createdAt)
+		return dbManager.logError(ctx, "link identity", err)
+	})
+
+	return user, err
+}
+
+// queryRecipes runs a query selecting recipe columns and closes the rows
+// once they are scanned.
+func (dbManager *DBManager) queryRecipes(ctx context.Context, op, query string, args ...interface{}) ([]Recipe, error) {
+	ctx, cancel := dbManager.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := dbManager.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, dbManager.logError(ctx, op, err)
+	}
+	defer rows.Close()
+
+	recipes := []Recipe{}
+	for rows.Next() {
+		recipe := Recipe{}
+		err = rows.Scan(&recipe.ID, &recipe.Name, &recipe.PrepTime, &recipe.Difficulty, &recipe.Vegeterian, &recipe.CreatedAt, &recipe.UpdatedAt, &recipe.Rating, &recipe.RatingCount, &recipe.Version)
+		if err != nil {
+			return nil, dbManager.logError(ctx, op, err)
+		}
+
+		recipes = append(recipes, recipe)
+	}
+
+	return recipes, dbManager.logError(ctx, op, rows.Err())
+}
+
+func (dbManager *DBManager) GetRecipes(ctx context.Context, recipeID int64, items, page int) ([]Recipe, error) {
+	whereClause := "WHERE a.deleted_at IS NULL"
 	limitClause := ""
 	offsetClause := ""
 
 	if recipeID > 0 {
-		whereClause = " WHERE a.id = $1"
+		whereClause += " AND a.id = $1"
 	} else {
 		if items > 0 {
 			limitClause = fmt.Sprintf("LIMIT %v", items)
@@ -160,7 +1029,7 @@ func (dbManager *DBManager) GetRecipes(recipeID int64, items, page int) ([]Recip
 	}
 
 	query := fmt.Sprintf(`
-			SELECT a.id, a.name, a.prep_time, a.difficulty, a.vegeterian, a.createdat, a.updatedat, COALESCE(AVG(b.rate), 0) AS rating
+			SELECT a.id, a.name, a.prep_time, a.difficulty, a.vegeterian, a.createdat, a.updatedat, COALESCE(AVG(b.rate), 0) AS rating, COUNT(b.rate) AS ratings, a.version
 			FROM app.recipes a
 			LEFT OUTER JOIN app.rates b
 			ON a.id = b.recipeID
@@ -170,54 +1039,70 @@ func (dbManager *DBManager) GetRecipes(recipeID int64, items, page int) ([]Recip
 			%s %s;
 		`, whereClause, limitClause, offsetClause)
 
-	var err error
-	var rows *sql.Rows
 	if recipeID > 0 {
-		rows, err = dbManager.db.Query(query, recipeID)
-	} else {
-		rows, err = dbManager.db.Query(query)
+		return dbManager.queryRecipes(ctx, "get recipes", query, recipeID)
 	}
+	return dbManager.queryRecipes(ctx, "get recipes", query)
+}
+
+// ExportRecipes calls fn with each recipe matching filters, all of them when
+// filters is empty, with its ratings aggregates, without loading them all.
+func (dbManager *DBManager) ExportRecipes(ctx context.Context, filters string, fn func(recipe ExportedRecipe) error) error {
+	ctx, cancel := dbManager.withBulkTimeout(ctx)
+	defer cancel()
+
+	whereClause := ""
+	if len(filters) != 0 {
+		whereClause = fmt.Sprintf("WHERE %s", filters)
+	}
+	query := fmt.Sprintf(`
+		SELECT * FROM
+			(SELECT a.id, a.name, a.prep_time, a.difficulty, a.vegeterian, COALESCE(AVG(b.rate), 0) AS rating,
+				COUNT(b.rate) AS ratings, a.createdat, a.updatedat
+			FROM app.recipes a
+			LEFT OUTER JOIN app.rates b
+			ON a.id = b.recipeID
+			WHERE a.deleted_at IS NULL
+			GROUP BY 1, 2, 3, 4, 5) a
+			%s
+			ORDER BY id;
+		`, whereClause)
+
+	rows, err := dbManager.db.QueryContext(ctx, query)
 	if err != nil {
-		return nil, err
+		return dbManager.logError(ctx, "export recipes", err)
 	}
+	defer rows.Close()
 
-	recipes := []Recipe{}
 	for rows.Next() {
-		recipe := Recipe{}
-		err = rows.Scan(&recipe.ID, &recipe.Name, &recipe.PrepTime, &recipe.Difficulty, &recipe.Vegeterian, &recipe.CreatedAt, &recipe.UpdatedAt, &recipe.Rating)
+		recipe := ExportedRecipe{}
+		err = rows.Scan(&recipe.ID, &recipe.Name, &recipe.PrepTime, &recipe.Difficulty, &recipe.Vegeterian, &recipe.Rating,
+			&recipe.RatingCount, &recipe.CreatedAt, &recipe.UpdatedAt)
 		if err != nil {
-			return nil, err
+			return dbManager.logError(ctx, "export recipes", err)
 		}
 
-		recipes = append(recipes, recipe)
+		if err := fn(recipe); err != nil {
+			return err
+		}
 	}
 
-	return recipes, nil
+	return dbManager.logError(ctx, "export recipes", rows.Err())
 }
 
-func (dbManager *DBManager) GetRecipesByFilters(filters string) ([]Recipe, error) {
-	recipes := []Recipe{}
+func (dbManager *DBManager) GetRecipesByFilters(ctx context.Context, filters string) ([]Recipe, error) {
 	whereClause := fmt.Sprintf("WHERE %s", filters)
 	query := fmt.Sprintf(`
 		SELECT * FROM
-			(SELECT a.id, a.name, a.prep_time, a.difficulty, a.vegeterian, a.createdat, a.updatedat, COALESCE(AVG(b.rate), 0) AS rating
+			(SELECT a.id, a.name, a.prep_time, a.difficulty, a.vegeterian, a.createdat, a.updatedat, COALESCE(AVG(b.rate), 0) AS rating, COUNT(b.rate) AS ratings, a.version
 			FROM app.recipes a
 			LEFT OUTER JOIN app.rates b
 			ON a.id = b.recipeID
+			WHERE a.deleted_at IS NULL
 			GROUP BY 1, 2, 3, 4, 5) a
 			%s
 			ORDER BY createdat DESC;
 		`, whereClause)
-	res, err := dbManager.db.Query(query)
-	if err != nil {
-		return recipes, err
-	}
-
-	for res.Next() {
-		recipe := Recipe{}
-		res.Scan(&recipe.ID, &recipe.Name, &recipe.PrepTime, &recipe.Difficulty, &recipe.Vegeterian, &recipe.CreatedAt, &recipe.UpdatedAt, &recipe.Rating)
-		recipes = append(recipes, recipe)
-	}
 
-	return recipes, nil
+	return dbManager.queryRecipes(ctx, "get recipes by filters", query)
 }
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The types below are the public representation of API version 1. Storage
+// structs like Recipe are converted to them before being written, so they
+// can change without breaking clients.
+
+// RecipeV1 is a recipe as returned by the API. PrepTime is in seconds and
+// PrepTimeText is the same duration for display, e.g. "1h 30m".
+type RecipeV1 struct {
+	XMLName      struct{}      `json:"-" xml:"recipe"`
+	ID           int64         `json:"id" xml:"id"`
+	Name         string        `json:"name" xml:"name"`
+	PrepTime     int           `json:"prep_time" xml:"prep_time"`
+	PrepTimeText string        `json:"prep_time_text" xml:"prep_time_text"`
+	Difficulty   int8          `json:"difficulty" xml:"difficulty"`
+	Vegetarian   bool          `json:"vegetarian" xml:"vegetarian"`
+	Rating       float64       `json:"rating" xml:"rating"`
+	RatingCount  int64         `json:"rating_count" xml:"rating_count"`
+	CreatedAt    time.Time     `json:"created_at" xml:"created_at"`
+	UpdatedAt    time.Time     `json:"updated_at" xml:"updated_at"`
+	Version      int           `json:"version" xml:"version"`
+	Links        RecipeLinksV1 `json:"links" xml:"links"`
+}
+
+// RecipeLinksV1 are the URLs of the resources related to a recipe.
+type RecipeLinksV1 struct {
+	Self      string `json:"self" xml:"self"`
+	Rate      string `json:"rate" xml:"rate"`
+	Revisions string `json:"revisions" xml:"revisions"`
+}
+
+type DeletedRecipeV1 struct {
+	RecipeV1
+	XMLName   struct{}  `json:"-" xml:"deleted_recipe"`
+	DeletedAt time.Time `json:"deleted_at" xml:"deleted_at"`
+}
+
+type RecipeFieldsV1 struct {
+	Name       string `json:"name" xml:"name"`
+	PrepTime   int    `json:"prep_time" xml:"prep_time"`
+	Difficulty int8   `json:"difficulty" xml:"difficulty"`
+	Vegetarian bool   `json:"vegetarian" xml:"vegetarian"`
+}
+
+type RecipeRevisionV1 struct {
+	XMLName   struct{}       `json:"-" xml:"revision"`
+	Revision  int            `json:"revision" xml:"revision"`
+	RecipeID  int64          `json:"recipe_id" xml:"recipe_id"`
+	UserID    int64          `json:"user_id,omitempty" xml:"user_id,omitempty"`
+	CreatedAt time.Time      `json:"created_at" xml:"created_at"`
+	Old       RecipeFieldsV1 `json:"old" xml:"old"`
+	New       RecipeFieldsV1 `json:"new" xml:"new"`
+}
+
+type FieldChangeV1 struct {
+	XMLName struct{}    `json:"-" xml:"change"`
+	Field   string      `json:"field" xml:"field"`
+	From    interface{} `json:"from" xml:"from"`
+	To      interface{} `json:"to" xml:"to"`
+}
+
+// APIKeyV1 is a personal API key. Only its prefix is returned, the key
+// itself is in CreatedAPIKeyV1 once.
+type APIKeyV1 struct {
+	XMLName    struct{}   `json:"-" xml:"api_key"`
+	ID         int64      `json:"id" xml:"id"`
+	Name       string     `json:"name" xml:"name"`
+	Prefix     string     `json:"prefix" xml:"prefix"`
+	Scopes     []string   `json:"scopes" xml:"scopes>scope"`
+	CreatedAt  time.Time  `json:"created_at" xml:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at" xml:"last_used_at,omitempty"`
+}
+
+type CreatedAPIKeyV1 struct {
+	APIKeyV1
+	XMLName struct{} `json:"-" xml:"created_api_key"`
+	Key     string   `json:"key" xml:"key"`
+}
+
+// SessionV1 is a cookie session of the user. Current marks the session of
+// the request.
+type SessionV1 struct {
+	XMLName   struct{}  `json:"-" xml:"session"`
+	ID        string    `json:"id" xml:"id"`
+	LoginTime time.Time `json:"login_time" xml:"login_time"`
+	LastSeen  time.Time `json:"last_seen" xml:"last_seen"`
+	UserAgent string    `json:"user_agent" xml:"user_agent"`
+	IP        string    `json:"ip" xml:"ip"`
+	Current   bool      `json:"current" xml:"current"`
+}
+
+// TokensV1 is an OAuth 2 style token response of a JWT session.
+type TokensV1 struct {
+	XMLName      struct{} `json:"-" xml:"tokens"`
+	AccessToken  string   `json:"access_token" xml:"access_token"`
+	TokenType    string   `json:"token_type" xml:"token_type"`
+	ExpiresIn    int64    `json:"expires_in" xml:"expires_in"`
+	RefreshToken string   `json:"refresh_token" xml:"refresh_token"`
+}
+
+func recipeLinksV1(recipeID int64) RecipeLinksV1 {
+	self := fmt.Sprintf("%s/recipes/%d", v1Prefix, recipeID)
+	return RecipeLinksV1{
+		Self:      self,
+		Rate:      self + "/rate",
+		Revisions: self + "/revisions",
+	}
+}
+
+func recipeV1(recipe Recipe) RecipeV1 {
+	return RecipeV1{
+		ID:           recipe.ID,
+		Name:         recipe.Name,
+		PrepTime:     recipe.PrepTime,
+		PrepTimeText: humanDuration(recipe.PrepTime),
+		Difficulty:   recipe.Difficulty,
+		Vegetarian:   recipe.Vegeterian,
+		Rating:       recipe.Rating,
+		RatingCount:  recipe.RatingCount,
+		CreatedAt:    recipe.CreatedAt,
+		UpdatedAt:    recipe.UpdatedAt,
+		Version:      recipe.Version,
+		Links:        recipeLinksV1(recipe.ID),
+	}
+}
+
+func recipesV1(recipes []Recipe) []RecipeV1 {
+	dtos := []RecipeV1{}
+	for _, recipe := range recipes {
+		dtos = append(dtos, recipeV1(recipe))
+	}
+	return dtos
+}
+
+func deletedRecipesV1(recipes []DeletedRecipe) []DeletedRecipeV1 {
+	dtos := []DeletedRecipeV1{}
+	for _, recipe := range recipes {
+		dtos = append(dtos, DeletedRecipeV1{RecipeV1: recipeV1(recipe.Recipe), DeletedAt: recipe.DeletedAt})
+	}
+	return dtos
+}
+
+func recipeFieldsV1(fields RecipeFields) RecipeFieldsV1 {
+	return RecipeFieldsV1{
+		Name:       fields.Name,
+		PrepTime:   fields.PrepTime,
+		Difficulty: fields.Difficulty,
+		Vegetarian: fields.Vegeterian,
+	}
+}
+
+func recipeRevisionV1(revision RecipeRevision) RecipeRevisionV1 {
+	return RecipeRevisionV1{
+		Revision:  revision.Revision,
+		RecipeID:  revision.RecipeID,
+		UserID:    revision.UserID,
+		CreatedAt: revision.CreatedAt,
+		Old:       recipeFieldsV1(revision.Old),
+		New:       recipeFieldsV1(revision.New),
+	}
+}
+
+func recipeRevisionsV1(revisions []RecipeRevision) []RecipeRevisionV1 {
+	dtos := []RecipeRevisionV1{}
+	for _, revision := range revisions {
+		dtos = append(dtos, recipeRevisionV1(revision))
+	}
+	return dtos
+}
+
+func fieldChangesV1(changes []FieldChange) []FieldChangeV1 {
+	dtos := []FieldChangeV1{}
+	for _, change := range changes {
+		dtos = append(dtos, FieldChangeV1{Field: change.Field, From: change.From, To: change.To})
+	}
+	return dtos
+}
+
+// humanDuration formats seconds for display, e.g. "1h 30m" or "45s".
+func humanDuration(seconds int) string {
+	if seconds <= 0 {
+		return "0s"
+	}
+
+	parts := []string{}
+	for _, unit := range []struct {
+		seconds int
+		suffix  string
+	}{{3600, "h"}, {60, "m"}, {1, "s"}} {
+		if seconds >= unit.seconds {
+			parts = append(parts, fmt.Sprintf("%d%s", seconds/unit.seconds, unit.suffix))
+			seconds %= unit.seconds
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func apiKeyV1(apiKey APIKey) APIKeyV1 {
+	return APIKeyV1{
+		ID:         apiKey.ID,
+		Name:       apiKey.Name,
+		Prefix:     apiKey.Prefix,
+		Scopes:     apiKey.Scopes,
+		CreatedAt:  apiKey.CreatedAt,
+		LastUsedAt: apiKey.LastUsedAt,
+	}
+}
+
+func apiKeysV1(apiKeys []APIKey) []APIKeyV1 {
+	dtos := []APIKeyV1{}
+	for _, apiKey := range apiKeys {
+		dtos = append(dtos, apiKeyV1(apiKey))
+	}
+	return dtos
+}
+
+func sessionsV1(sessions []Session, current Session) []SessionV1 {
+	dtos := []SessionV1{}
+	for _, session := range sessions {
+		dtos = append(dtos, SessionV1{
+			ID:        session.ID(),
+			LoginTime: session.LoginTime,
+			LastSeen:  session.LastSeen,
+			UserAgent: session.UserAgent,
+			IP:        session.IP,
+			Current:   isSameSession(session, current),
+		})
+	}
+	return dtos
+}
+
+func tokensV1(tokens Tokens) TokensV1 {
+	return TokensV1{
+		AccessToken:  tokens.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    tokens.ExpiresIn,
+		RefreshToken: tokens.RefreshToken,
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// VersionMatch is the set of recipe versions accepted by an If-Match header.
+// A nil VersionMatch accepts any version.
+type VersionMatch []int
+
+func (match VersionMatch) Matches(version int) bool {
+	if match == nil {
+		return true
+	}
+	for _, v := range match {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// recipeETag is the strong entity tag of a recipe version in a media type,
+// like "3-xml", as each representation needs its own strong tag.
+func recipeETag(version int, mediaType string) string {
+	_, subtype, _ := strings.Cut(mediaType, "/")
+	return fmt.Sprintf(`"%d-%s"`, version, subtype)
+}
+
+// parseETags splits an If-Match or If-None-Match header into its entity
+// tags, each with its W/ prefix if any.
+func parseETags(header string) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if len(tag) != 0 {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// ifMatchVersions returns the recipe versions accepted by the If-Match header
+// of r. It is nil when the header is missing or "*", which only requires the
+// recipe to exist. Weak tags never match as If-Match uses strong comparison.
+func ifMatchVersions(r *http.Request) VersionMatch {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if len(header) == 0 || header == "*" {
+		return nil
+	}
+
+	match := VersionMatch{}
+	for _, tag := range parseETags(header) {
+		if !strings.HasPrefix(tag, `"`) || !strings.HasSuffix(tag, `"`) || len(tag) < 2 {
+			continue
+		}
+		// Every representation of a version matches, they are updated together
+		value, _, _ := strings.Cut(tag[1:len(tag)-1], "-")
+		version, err := strconv.Atoi(value)
+		if err == nil {
+			match = append(match, version)
+		}
+	}
+	return match
+}
+
+// checkIfMatch answers 428 when If-Match is required but missing and
+// reports whether the request may go on.
+func checkIfMatch(w http.ResponseWriter, r *http.Request) bool {
+	if config.HTTP.RequireIfMatch && len(r.Header.Get("If-Match")) == 0 {
+		http.Error(w, "If-Match header is required", http.StatusPreconditionRequired)
+		return false
+	}
+	return true
+}
+
+// notModified reports whether the If-None-Match header of r matches etag,
+// using weak comparison.
+func notModified(r *http.Request, etag string) bool {
+	header := strings.TrimSpace(r.Header.Get("If-None-Match"))
+	if header == "*" {
+		return true
+	}
+	for _, tag := range parseETags(header) {
+		if strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
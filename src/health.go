@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// buildCommit is set at build time with -ldflags "-X main.buildCommit=..."
+var buildCommit = "unknown"
+
+// expectedSchemaVersion is the schema version /readyz requires, replaced
+// by tests.
+var expectedSchemaVersion = LatestMigrationVersion
+
+// draining is set once graceful shutdown starts so /readyz fails.
+var draining int32
+
+func setDraining() {
+	atomic.StoreInt32(&draining, 1)
+}
+
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+type VersionInfo struct {
+	Commit          string `json:"commit"`
+	SchemaVersion   int    `json:"schema_version"`
+	DBSchemaVersion int    `json:"db_schema_version"`
+}
+
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	fmt.Fprint(w, "ok")
+}
+
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := checkReadiness(r); err != nil {
+		loggerFrom(r.Context()).Warn("not ready", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	fmt.Fprint(w, "ok")
+}
+
+func checkReadiness(r *http.Request) error {
+	if isDraining() {
+		return fmt.Errorf("shutting down")
+	}
+
+	if err := db.Ping(r.Context()); err != nil {
+		return fmt.Errorf("db is not reachable: %s", err)
+	}
+
+	version, err := db.SchemaVersion(r.Context())
+	if err != nil {
+		return fmt.Errorf("could not get schema version: %s", err)
+	}
+	if expected := expectedSchemaVersion(); version < expected {
+		return fmt.Errorf("schema version %d is older than expected %d", version, expected)
+	}
+
+	if err := sessionManager.Ping(r.Context()); err != nil {
+		return fmt.Errorf("session store is not reachable: %s", err)
+	}
+
+	return nil
+}
+
+func VersionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	info := VersionInfo{
+		Commit:        buildCommit,
+		SchemaVersion: LatestMigrationVersion(),
+	}
+
+	version, err := db.SchemaVersion(r.Context())
+	if err != nil {
+		loggerFrom(r.Context()).Error("could not get schema version", "error", err)
+	}
+	info.DBSchemaVersion = version
+
+	writeResponse(w, r, http.StatusOK, info)
+}
@@ -1,51 +1,130 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
 )
 
-func CreateRecipe(name string, prepTime int, difficulty int8, vegeterian bool) error {
+func CreateRecipe(ctx context.Context, name string, prepTime int, difficulty int8, vegeterian bool) error {
 	createdAt := time.Now().UTC()
-	err := db.ExecInsertRecipeQuery(name, prepTime, difficulty, vegeterian, createdAt)
+	err := db.ExecInsertRecipeQuery(ctx, name, prepTime, difficulty, vegeterian, createdAt)
 	return err
 }
 
-func DeleteRecipe(recipeID int64) error {
-	idVal := strconv.FormatInt(recipeID, 10)
-
-	// Delete all recipe rates first
-	err := db.ExecDeleteQuery("app.rates", "recipeid", idVal)
-	if err != nil {
-		return err
+// DeleteRecipe moves a recipe to the trash, or deletes it and its rates
+// for good when permanent is set. The recipe version must be in match.
+func DeleteRecipe(ctx context.Context, recipeID int64, permanent bool, match VersionMatch) error {
+	if permanent {
+		return db.DeleteRecipe(ctx, recipeID, match)
 	}
 
-	// Then, delete it
-	return db.ExecDeleteQuery("app.recipes", "id", idVal)
+	return db.SoftDeleteRecipe(ctx, recipeID, time.Now().UTC(), match)
+}
+
+func RestoreRecipe(ctx context.Context, recipeID int64) error {
+	return db.RestoreRecipe(ctx, recipeID)
 }
 
-func UpdateRecipe(recipeID int64, params map[string]string) error {
-	updateClauses := []string{}
-	params["name"] = fmt.Sprintf("'%s'", db.EscapeQuotes(params["name"]))
-	params["updatedat"] = fmt.Sprintf("'%s'", time.Now().UTC().Format(time.RFC3339))
+// UpdateRecipe updates the recipe columns given in params and records the
+// change as a revision by the request user. The recipe version must be in
+// match.
+func UpdateRecipe(ctx context.Context, recipeID int64, params map[string]string, match VersionMatch) error {
+	update := RecipeUpdate{}
 	for col, value := range params {
-		updateClauses = append(updateClauses, fmt.Sprintf("%s = %s", col, value))
+		switch col {
+		case "name":
+			name := value
+			update.Name = &name
+		case "prep_time":
+			prepTime, err := strconv.ParseInt(value, 10, 32)
+			if err != nil {
+				return notValid(col)
+			}
+			p := int(prepTime)
+			update.PrepTime = &p
+		case "difficulty":
+			difficulty, err := strconv.ParseInt(value, 10, 8)
+			if err != nil {
+				return notValid(col)
+			}
+			d := int8(difficulty)
+			update.Difficulty = &d
+		case "vegetarian", "vegeterian":
+			vegetarian, err := strconv.ParseBool(value)
+			if err != nil {
+				return notValid("vegetarian")
+			}
+			update.Vegeterian = &vegetarian
+		default:
+			return &ValidationError{col, fmt.Sprintf("column %s can not be updated", col)}
+		}
 	}
 
-	query := fmt.Sprintf("UPDATE app.recipes SET %s WHERE id = %v;", strings.Join(updateClauses, ", "), recipeID)
-	_, err = db.ExecQuery(query)
+	_, err := db.UpdateRecipe(ctx, recipeID, update.Change(), requestUserID(ctx), match)
+	return err
+}
+
+// ReplaceRecipe sets every field of a recipe, recording a revision by the
+// request user. The recipe version must be in match.
+func ReplaceRecipe(ctx context.Context, recipeID int64, fields RecipeFields, match VersionMatch) error {
+	_, err := db.UpdateRecipe(ctx, recipeID, fullUpdate(fields).Change(), requestUserID(ctx), match)
 	return err
 }
 
-func RateRecipe(recipeID int64, rate int8) error {
+// PatchRecipe applies a JSON Merge Patch or JSON Patch to a recipe, recording
+// a revision by the request user. The recipe version must be in match.
+func PatchRecipe(ctx context.Context, recipeID int64, patch DocumentPatch, match VersionMatch) error {
+	_, err := db.UpdateRecipe(ctx, recipeID, patchChange(patch), requestUserID(ctx), match)
+	return err
+}
+
+// RevertRecipe sets the recipe fields back to how they were right after the
+// given revision (0 for the recipe as created), recording a new revision.
+// The recipe version must be in match.
+func RevertRecipe(ctx context.Context, recipeID int64, revision int, match VersionMatch) (RecipeRevision, error) {
+	revisions, err := db.GetRecipeRevisions(ctx, recipeID)
+	if err != nil {
+		return RecipeRevision{}, err
+	}
+
+	fields, err := recipeStateAt(revisions, revision)
+	if err != nil {
+		return RecipeRevision{}, err
+	}
+
+	return db.UpdateRecipe(ctx, recipeID, fullUpdate(fields).Change(), requestUserID(ctx), match)
+}
+
+// DiffRecipeRevisions lists the fields changed between two revisions of a
+// recipe, 0 being the recipe as created.
+func DiffRecipeRevisions(ctx context.Context, recipeID int64, from, to int) ([]FieldChange, error) {
+	revisions, err := db.GetRecipeRevisions(ctx, recipeID)
+	if err != nil {
+		return nil, err
+	}
+
+	fromFields, err := recipeStateAt(revisions, from)
+	if err != nil {
+		return nil, err
+	}
+	toFields, err := recipeStateAt(revisions, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return DiffRecipeFields(fromFields, toFields), nil
+}
+
+func RateRecipe(ctx context.Context, recipeID int64, rate int8) error {
 	createdAt := time.Now().UTC()
-	return db.ExecInsertRateQuery(recipeID, rate, createdAt)
+	return db.ExecInsertRateQuery(ctx, recipeID, rate, createdAt)
 }
 
-func IsUserExists(username string) bool {
-	_, err := db.GetUser(username)
+func IsUserExists(ctx context.Context, username string) bool {
+	_, err := db.GetUser(ctx, username)
 	if err != nil && strings.Contains(err.Error(), "not found") {
 		return false
 	}
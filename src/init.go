@@ -1,80 +1,78 @@
 package main
 
 import (
-	"log"
-	"os"
-	"strconv"
+	"context"
 	"time"
 )
 
 type Recipe struct {
-	ID         int64
-	Name       string
-	PrepTime   int
-	Difficulty int8
-	Vegeterian bool
-	Rating     float64
-	CreatedAt  time.Time
-	UpdatedAt  time.Time
+	ID          int64
+	Name        string
+	PrepTime    int
+	Difficulty  int8
+	Vegeterian  bool
+	Rating      float64
+	RatingCount int64
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Version     int
 }
 
+// DeletedRecipe is a recipe in the trash.
+type DeletedRecipe struct {
+	Recipe
+	DeletedAt time.Time
+}
+
+var config Config
 var db *DBManager
 var sessionManager *SessionManager
+var oidcClient *OIDCClient
+var trashPurger *TrashPurger
 var err error
 
-func init() {
-	log.Println("initiate web server..")
-	envMSG := CheckEnvVars()
-	if len(envMSG) != 0 {
-		log.Fatalln("ENVIRONMENT VARIABLE NOT SET:", envMSG)
-		return
-	}
+// initServer connects to the database and creates the session manager.
+// Background jobs stop when ctx is cancelled.
+func initServer(ctx context.Context, cfg Config) error {
+	logger.Info("initiate web server..")
+	config = cfg
 
 	// Create DB object
-	db, err = InitConnection(os.Getenv("DB_HOST"), os.Getenv("DB_USER"), os.Getenv("DB_PASS"), os.Getenv("DB_NAME"), os.Getenv("DB_PORT"))
+	db, err = InitConnection(ctx, cfg.DB)
 	if err != nil {
-		log.Fatalln("cannot connect to db", err)
+		logger.Error("cannot connect to db", "error", err)
+		return err
 	}
 
-	// Create authentication objects
-	maxAge, err := strconv.ParseInt(os.Getenv("COOKIE_MAX_AGE"), 10, 64)
-	if err != nil {
-		log.Println("invalid COOKIE_MAX_AGE value: Set to default (3600)")
-		maxAge = 3600
+	if cfg.DB.AutoMigrate {
+		if _, err := db.MigrateUp(ctx); err != nil {
+			logger.Error("cannot apply migrations", "error", err)
+			return err
+		}
 	}
-	cleanUpTime, err := strconv.ParseInt(os.Getenv("CLEANUP_SESSIONS"), 10, 64)
+
+	// Create authentication objects
+	sessionStore, err := newSessionStore(cfg.Session)
 	if err != nil {
-		log.Println("invalid CLEANUP_SESSIONS value: Set to default (3600)")
-		cleanUpTime = 3600
+		logger.Error("cannot create session store", "error", err)
+		return err
 	}
-	sessionManager, err = NewSessionManager(os.Getenv("COOKIE_SID"), maxAge, cleanUpTime)
+	sessionManager, err = NewSessionManager(ctx, sessionStore, cfg.Session.CookieSID, cfg.Session.CookieMaxAge, cfg.Session.CleanupInterval)
 	if err != nil {
-		log.Fatalln("cannot create session manager", err)
+		logger.Error("cannot create session manager", "error", err)
+		return err
 	}
-}
 
-func CheckEnvVars() string {
-	if len(os.Getenv("PORT")) == 0 {
-		return "PORT NOT SET"
+	if len(cfg.OIDC.Issuer) != 0 {
+		oidcClient = NewOIDCClient(cfg.OIDC)
 	}
-	if len(os.Getenv("DB_HOST")) == 0 {
-		return "DB_HOST NOT SET"
-	}
-	if len(os.Getenv("DB_NAME")) == 0 {
-		return "DB_NAME NOT SET"
-	}
-	if len(os.Getenv("DB_USER")) == 0 {
-		return "DB_USER NOT SET"
-	}
-	if len(os.Getenv("DB_PASS")) == 0 {
-		return "DB_PASS NOT SET"
-	}
-	if len(os.Getenv("DB_PORT")) == 0 {
-		return "DB_PORT NOT SET"
-	}
-	if len(os.Getenv("COOKIE_SID")) == 0 {
-		return "COOKIE_SID NOT SET"
+
+	trashPurger = NewTrashPurger(ctx, time.Duration(cfg.Trash.Retention)*time.Second, time.Duration(cfg.Trash.PurgeInterval)*time.Second)
+
+	if err := registerMetrics(); err != nil {
+		logger.Error("cannot register metrics", "error", err)
+		return err
 	}
 
-	return ""
+	return nil
 }
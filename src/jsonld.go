@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const jsonldMediaType = "application/ld+json"
+
+const schemaOrgContext = "https://schema.org"
+
+// defaultJSONLDDifficulty is the difficulty of imported JSON-LD recipes
+// unless the import sets one.
+const defaultJSONLDDifficulty = 2
+
+// RecipeJSONLD is a recipe as a schema.org Recipe, see
+// https://schema.org/Recipe.
+type RecipeJSONLD struct {
+	Context         string                 `json:"@context"`
+	Type            string                 `json:"@type"`
+	Identifier      int64                  `json:"identifier"`
+	Name            string                 `json:"name"`
+	PrepTime        string                 `json:"prepTime"`
+	SuitableForDiet string                 `json:"suitableForDiet,omitempty"`
+	AggregateRating *AggregateRatingJSONLD `json:"aggregateRating,omitempty"`
+	DateCreated     string                 `json:"dateCreated"`
+	DateModified    string                 `json:"dateModified"`
+}
+
+type AggregateRatingJSONLD struct {
+	Type        string  `json:"@type"`
+	RatingValue float64 `json:"ratingValue"`
+	RatingCount int64   `json:"ratingCount"`
+	BestRating  int     `json:"bestRating"`
+	WorstRating int     `json:"worstRating"`
+}
+
+// recipeJSONLD maps a recipe to schema.org, leaving aggregateRating out of
+// recipes without ratings as schema.org requires a ratingCount above 0.
+func recipeJSONLD(recipe Recipe) RecipeJSONLD {
+	doc := RecipeJSONLD{
+		Context:      schemaOrgContext,
+		Type:         "Recipe",
+		Identifier:   recipe.ID,
+		Name:         recipe.Name,
+		PrepTime:     formatISODuration(recipe.PrepTime),
+		DateCreated:  recipe.CreatedAt.Format(time.RFC3339),
+		DateModified: recipe.UpdatedAt.Format(time.RFC3339),
+	}
+	if recipe.Vegeterian {
+		doc.SuitableForDiet = schemaOrgContext + "/VegetarianDiet"
+	}
+	if recipe.RatingCount > 0 {
+		doc.AggregateRating = &AggregateRatingJSONLD{
+			Type:        "AggregateRating",
+			RatingValue: math.Round(recipe.Rating*100) / 100,
+			RatingCount: recipe.RatingCount,
+			BestRating:  5,
+			WorstRating: 1,
+		}
+	}
+
+	return doc
+}
+
+// formatISODuration formats seconds as an ISO 8601 duration, e.g. PT1H30M.
+func formatISODuration(seconds int) string {
+	if seconds <= 0 {
+		return "PT0S"
+	}
+
+	duration := "PT"
+	if seconds >= 3600 {
+		duration += fmt.Sprintf("%dH", seconds/3600)
+	}
+	if seconds%3600 >= 60 {
+		duration += fmt.Sprintf("%dM", seconds%3600/60)
+	}
+	if seconds%60 != 0 {
+		duration += fmt.Sprintf("%dS", seconds%60)
+	}
+	return duration
+}
+
+var isoDurationRegexp = regexp.MustCompile(`^P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+(?:\.\d+)?)H)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseISODuration parses an ISO 8601 duration into seconds, rounded up.
+// Years and months are not supported as their length varies.
+func parseISODuration(duration string) (int, error) {
+	normalized := strings.ToUpper(strings.TrimSpace(duration))
+	matches := isoDurationRegexp.FindStringSubmatch(normalized)
+	if matches == nil || normalized == "P" || strings.HasSuffix(normalized, "T") {
+		return 0, fmt.Errorf("%q is not a valid ISO 8601 duration", duration)
+	}
+
+	seconds := 0.0
+	for i, unit := range []float64{7 * 24 * 3600, 24 * 3600, 3600, 60, 1} {
+		if len(matches[i+1]) == 0 {
+			continue
+		}
+		n, _ := strconv.ParseFloat(matches[i+1], 64)
+		seconds += n * unit
+	}
+	if seconds > math.MaxInt32 {
+		return 0, fmt.Errorf("%q is too long", duration)
+	}
+
+	return int(math.Ceil(seconds)), nil
+}
+
+// jsonldRecipeRows reads the schema.org Recipe nodes of a JSON-LD document,
+// either a single node, an array of nodes or a @graph. Other nodes are
+// skipped. schema.org has no difficulty, so every recipe gets difficulty.
+type jsonldRecipeRows struct {
+	nodes      []map[string]interface{}
+	difficulty int8
+	row        int
+}
+
+func newJSONLDRecipeRows(r io.Reader, difficulty int8) (*jsonldRecipeRows, error) {
+	var doc interface{}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("JSON-LD document is not valid JSON: %s", err)
+	}
+
+	rows := &jsonldRecipeRows{difficulty: difficulty}
+	rows.collect(doc)
+	if len(rows.nodes) == 0 {
+		return nil, fmt.Errorf("JSON-LD document has no schema.org Recipe")
+	}
+
+	return rows, nil
+}
+
+func (rows *jsonldRecipeRows) collect(doc interface{}) {
+	switch v := doc.(type) {
+	case []interface{}:
+		for _, node := range v {
+			rows.collect(node)
+		}
+	case map[string]interface{}:
+		if graph, ok := v["@graph"]; ok {
+			rows.collect(graph)
+		}
+		if isSchemaOrgType(v["@type"], "Recipe") {
+			rows.nodes = append(rows.nodes, v)
+		}
+	}
+}
+
+// isSchemaOrgType reports whether a @type value, a string or an array of
+// strings, holds the given schema.org type.
+func isSchemaOrgType(value interface{}, name string) bool {
+	switch v := value.(type) {
+	case string:
+		return isSchemaOrgTerm(v, name)
+	case []interface{}:
+		for _, t := range v {
+			if s, ok := t.(string); ok && isSchemaOrgTerm(s, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isSchemaOrgTerm(value, name string) bool {
+	switch value {
+	case name, "schema:" + name, "https://schema.org/" + name, "http://schema.org/" + name:
+		return true
+	}
+	return false
+}
+
+// firstString returns a string value, or the first string of an array.
+func firstString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				return s, true
+			}
+		}
+	}
+	return "", false
+}
+
+// isVegetarian reports whether a suitableForDiet value lists the vegetarian
+// or vegan diet, as a term or a node with an @id.
+func isVegetarian(value interface{}) bool {
+	values, ok := value.([]interface{})
+	if !ok {
+		values = []interface{}{value}
+	}
+
+	for _, diet := range values {
+		if node, ok := diet.(map[string]interface{}); ok {
+			diet = node["@id"]
+		}
+		if s, ok := diet.(string); ok && (isSchemaOrgTerm(s, "VegetarianDiet") || isSchemaOrgTerm(s, "VeganDiet")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rows *jsonldRecipeRows) Next() (RecipeFields, error) {
+	if rows.row >= len(rows.nodes) {
+		return RecipeFields{}, io.EOF
+	}
+	node := rows.nodes[rows.row]
+	rows.row++
+
+	fields := RecipeFields{Difficulty: rows.difficulty, Vegeterian: isVegetarian(node["suitableForDiet"])}
+	fields.Name, _ = firstString(node["name"])
+
+	// Fall back to the total time for recipes without a preparation time
+	duration, ok := firstString(node["prepTime"])
+	if !ok {
+		duration, ok = firstString(node["totalTime"])
+	}
+	if !ok {
+		return fields, &ImportRowError{rows.row, "prepTime is not set"}
+	}
+	prepTime, err := parseISODuration(duration)
+	if err != nil {
+		return fields, &ImportRowError{rows.row, fmt.Sprintf("prepTime is not valid: %s", err)}
+	}
+	fields.PrepTime = prepTime
+
+	if err := fields.Validate(); err != nil {
+		return fields, &ImportRowError{rows.row, err.Error()}
+	}
+	return fields, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// logger writes JSON lines to stdout. main sets it as the slog default so
+// output of the standard log package is JSON too.
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+type contextKey int
+
+const requestInfoKey contextKey = iota
+
+// requestInfo is attached to each request context by loggingMiddleware.
+// UserID is filled in once the session is authenticated.
+type requestInfo struct {
+	ID     string
+	UserID int64
+}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey).(*requestInfo)
+	return info
+}
+
+// loggerFrom returns a logger carrying the request ID of ctx, if any.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if info := requestInfoFrom(ctx); info != nil {
+		return logger.With("request_id", info.ID)
+	}
+
+	return logger
+}
+
+func setRequestUser(ctx context.Context, userID int64) {
+	if info := requestInfoFrom(ctx); info != nil {
+		info.UserID = userID
+	}
+}
+
+// requestUserID returns the ID of the authenticated user of the request,
+// or 0 when there is none.
+func requestUserID(ctx context.Context) int64 {
+	if info := requestInfoFrom(ctx); info != nil {
+		return info.UserID
+	}
+	return 0
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID accepts client supplied IDs that are safe to log and echo.
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// loggingMiddleware propagates or generates the X-Request-ID header and
+// writes one JSON access log line per request.
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		info := &requestInfo{ID: id}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey, info))
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+
+		attrs := []any{
+			"method", r.Method,
+			"route", route,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+		}
+		if info.UserID != 0 {
+			attrs = append(attrs, "user_id", info.UserID)
+		}
+		loggerFrom(r.Context()).Info("request", attrs...)
+	})
+}
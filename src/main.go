@@ -1,30 +1,122 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
 )
 
 func main() {
-	router := mux.NewRouter()
+	slog.SetDefault(logger)
 
-	router.HandleFunc("/register", RegisterHandler)
-	router.HandleFunc("/login", LoginHandler)
-	router.HandleFunc("/logout", LogoutHandler)
+	// "migrate <up|down|status> [flags]" runs migrations instead of serving
+	args := os.Args[1:]
+	migrateAction := ""
+	if len(args) > 0 && args[0] == "migrate" {
+		if len(args) < 2 {
+			log.Fatalln("usage: migrate <up|down|status> [flags]")
+		}
+		migrateAction, args = args[1], args[2:]
+	}
 
-	router.HandleFunc("/recipes", RecipesHandler)
-	router.HandleFunc("/recipes/{id}", RecipeHandler)
-	router.HandleFunc("/recipes/{id}/rate", RateHandler)
-	router.HandleFunc("/search", SearchHandler)
+	cfg, printConfig, err := LoadConfig(args)
+	if err == flag.ErrHelp {
+		return
+	}
+	if printConfig {
+		if printErr := cfg.Print(); printErr != nil {
+			log.Fatalln("could not print config:", printErr)
+		}
+	}
+	if err != nil {
+		log.Fatalln("INVALID CONFIG:", err)
+	}
+	if printConfig {
+		return
+	}
 
-	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, "This is the main page")
-	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	http.Handle("/", router)
-	http.ListenAndServe(fmt.Sprintf(":%s", os.Getenv("PORT")), nil)
+	if len(migrateAction) != 0 {
+		db, err = InitConnection(ctx, cfg.DB)
+		if err != nil {
+			log.Fatalln("cannot connect to db:", err)
+		}
+		defer db.Close()
+
+		if err := runMigrateCommand(ctx, migrateAction, os.Stdout); err != nil {
+			log.Fatalln("migrate", migrateAction, "failed:", err)
+		}
+		return
+	}
+
+	if err := initServer(ctx, cfg); err != nil {
+		log.Fatalln("could not initiate web server:", err)
+	}
+
+	router := newRouter()
+
+	server := &http.Server{
+		Addr:         fmt.Sprintf(":%s", cfg.Port),
+		Handler:      router,
+		ReadTimeout:  time.Duration(cfg.HTTP.ReadTimeout) * time.Second,
+		WriteTimeout: time.Duration(cfg.HTTP.WriteTimeout) * time.Second,
+		IdleTimeout:  time.Duration(cfg.HTTP.IdleTimeout) * time.Second,
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		logger.Info("listening", "addr", server.Addr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	exitCode := 0
+	select {
+	case err := <-serverErr:
+		logger.Error("web server stopped", "error", err)
+		exitCode = 1
+	case sig := <-stop:
+		logger.Info("received signal, shutting down", "signal", sig.String())
+		setDraining()
+		// Keep serving while probes see /readyz fail, a second signal
+		// skips the wait
+		select {
+		case <-time.After(time.Duration(cfg.HTTP.ShutdownDelay) * time.Second):
+		case <-stop:
+		}
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), time.Duration(cfg.HTTP.ShutdownTimeout)*time.Second)
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Error("could not drain in-flight requests", "error", err)
+		}
+		shutdownCancel()
+	}
+
+	// Stop background jobs before closing the db pool they use
+	cancel()
+	sessionManager.Wait()
+	trashPurger.Wait()
+	if err := sessionManager.Close(); err != nil {
+		logger.Error("could not close session store", "error", err)
+	}
+	if err := db.Close(); err != nil {
+		logger.Error("could not close db connections", "error", err)
+	}
+	logger.Info("web server stopped")
+	if exitCode != 0 {
+		// Deferred calls do not run on exit, cancel was called above
+		os.Exit(exitCode)
+	}
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "recipe_api"
+
+// activeSessionsTimeout bounds the session count of a scrape.
+const activeSessionsTimeout = 5 * time.Second
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by route template, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route template and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	searchGroups = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "search_query_groups",
+		Help:      "Number of filter groups per search query.",
+		Buckets:   []float64{1, 2, 3, 5, 8, 13, 21},
+	})
+
+	searchFilters = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "search_query_filters",
+		Help:      "Number of filters per search query across all groups.",
+		Buckets:   []float64{1, 2, 3, 5, 8, 13, 21, 34},
+	})
+
+	logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "logins_total",
+		Help:      "Number of login attempts by result.",
+	}, []string{"result"})
+)
+
+// registerMetrics registers the service collectors with the default registry.
+// It must be called once the db and the session manager are initialized.
+func registerMetrics() error {
+	cs := []prometheus.Collector{
+		httpRequests,
+		httpDuration,
+		searchGroups,
+		searchFilters,
+		logins,
+		collectors.NewDBStatsCollector(db.db, "recipes"),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "active_sessions",
+			Help:      "Number of unexpired sessions in the session store.",
+		}, func() float64 {
+			// Scrapes have no deadline of their own
+			ctx, cancel := context.WithTimeout(context.Background(), activeSessionsTimeout)
+			defer cancel()
+			return float64(sessionManager.ActiveSessions(ctx))
+		}),
+	}
+
+	for _, c := range cs {
+		if err := prometheus.Register(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// statusRecorder keeps the status code sent by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	return rec.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// metricsMiddleware records request counts and latencies labelled with the
+// matched route template, so /recipes/1 and /recipes/2 share a series.
+// Requests matching no route, served by the router's NotFoundHandler, are
+// labelled "unmatched".
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+func observeSearchQuery(query SearchQuery) {
+	filters := 0
+	for _, group := range query.FilterGroups {
+		filters += len(group.Filters)
+	}
+
+	searchGroups.Observe(float64(len(query.FilterGroups)))
+	searchFilters.Observe(float64(filters))
+}
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS app.userSessions;
+DROP TABLE IF EXISTS app.users;
+DROP TABLE IF EXISTS app.rates;
+DROP TABLE IF EXISTS app.recipes;
+DROP SCHEMA IF EXISTS app;
@@ -1,8 +1,8 @@
 -- Build schema
-CREATE SCHEMA app;
+CREATE SCHEMA IF NOT EXISTS app;
 
 -- Recipe table and sequence
-CREATE SEQUENCE app.recipes_id_seq;
+CREATE SEQUENCE IF NOT EXISTS app.recipes_id_seq;
 
 CREATE TABLE IF NOT EXISTS app.recipes (
   id            INT           PRIMARY KEY   DEFAULT NEXTVAL('app.recipes_id_seq'),
@@ -17,7 +17,7 @@ CREATE TABLE IF NOT EXISTS app.recipes (
 ALTER SEQUENCE app.recipes_id_seq OWNED BY app.recipes.id;
 
 -- Recipes rates and sequence
-CREATE SEQUENCE app.rates_id_seq;
+CREATE SEQUENCE IF NOT EXISTS app.rates_id_seq;
 
 CREATE TABLE IF NOT EXISTS app.rates (
   id        INT         PRIMARY KEY   DEFAULT NEXTVAL('app.rates_id_seq'),
@@ -0,0 +1,3 @@
+ALTER TABLE app.rates
+  DROP CONSTRAINT IF EXISTS rates_recipeid_fkey,
+  ADD CONSTRAINT rates_recipeid_fkey FOREIGN KEY (recipeID) REFERENCES app.recipes(id);
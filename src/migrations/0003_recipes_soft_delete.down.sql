@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS app.recipes_deleted_at_idx;
+
+ALTER TABLE app.recipes DROP COLUMN IF EXISTS deleted_at;
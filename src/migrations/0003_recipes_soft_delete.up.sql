@@ -0,0 +1,4 @@
+-- Soft deleted recipes are kept in the trash until purged
+ALTER TABLE app.recipes ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP NULL;
+
+CREATE INDEX IF NOT EXISTS recipes_deleted_at_idx ON app.recipes (deleted_at) WHERE deleted_at IS NOT NULL;
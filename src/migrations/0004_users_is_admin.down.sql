@@ -0,0 +1 @@
+ALTER TABLE app.users DROP COLUMN IF EXISTS isAdmin;
@@ -0,0 +1,2 @@
+-- Admins can access the trash
+ALTER TABLE app.users ADD COLUMN IF NOT EXISTS isAdmin BOOLEAN NOT NULL DEFAULT FALSE;
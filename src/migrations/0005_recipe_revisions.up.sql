@@ -0,0 +1,14 @@
+-- Every recipe update is recorded as a revision with the recipe fields
+-- before and after it
+CREATE TABLE IF NOT EXISTS app.recipe_revisions (
+  id          SERIAL      PRIMARY KEY,
+  recipeID    INT         NOT NULL,
+  revision    INT         NOT NULL,
+  userID      INT         NULL,
+  old_values  JSONB       NOT NULL,
+  new_values  JSONB       NOT NULL,
+  createdat   TIMESTAMP   NOT NULL,
+  UNIQUE (recipeID, revision),
+  FOREIGN KEY (recipeID) REFERENCES app.recipes(id) ON DELETE CASCADE,
+  FOREIGN KEY (userID) REFERENCES app.users(id) ON DELETE SET NULL
+);
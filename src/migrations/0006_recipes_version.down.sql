@@ -0,0 +1 @@
+ALTER TABLE app.recipes DROP COLUMN IF EXISTS version;
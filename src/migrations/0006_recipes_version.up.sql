@@ -0,0 +1,2 @@
+-- Bumped on every change of a recipe, the recipe ETag is derived from it
+ALTER TABLE app.recipes ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
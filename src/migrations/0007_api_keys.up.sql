@@ -0,0 +1,16 @@
+-- Personal API keys, only a SHA-256 hash of each key is stored. Scopes are
+-- space separated like OAuth scopes
+CREATE TABLE IF NOT EXISTS app.api_keys (
+  id          SERIAL        PRIMARY KEY,
+  userID      INT           NOT NULL,
+  name        VARCHAR(128)  NOT NULL,
+  prefix      VARCHAR(16)   NOT NULL,
+  keyHash     CHAR(64)      NOT NULL UNIQUE,
+  scopes      VARCHAR(256)  NOT NULL,
+  createdat   TIMESTAMP     NOT NULL,
+  lastUsedAt  TIMESTAMP     NULL,
+  revokedAt   TIMESTAMP     NULL,
+  FOREIGN KEY (userID) REFERENCES app.users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS api_keys_userid_idx ON app.api_keys (userID);
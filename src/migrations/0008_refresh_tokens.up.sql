@@ -0,0 +1,16 @@
+-- Refresh tokens of JWT sessions, only a SHA-256 hash of each token is
+-- stored. Refreshing uses a token up and issues the next one of its family,
+-- so a reused token reveals a leak and revokes the whole family
+CREATE TABLE IF NOT EXISTS app.refresh_tokens (
+  id          SERIAL        PRIMARY KEY,
+  userID      INT           NOT NULL,
+  familyID    CHAR(32)      NOT NULL,
+  tokenHash   CHAR(64)      NOT NULL UNIQUE,
+  createdat   TIMESTAMP     NOT NULL,
+  expiresAt   TIMESTAMP     NOT NULL,
+  usedAt      TIMESTAMP     NULL,
+  revokedAt   TIMESTAMP     NULL,
+  FOREIGN KEY (userID) REFERENCES app.users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_familyid_idx ON app.refresh_tokens (familyID);
@@ -0,0 +1,11 @@
+-- Identities of users at OpenID Connect providers, a user logging in with
+-- OIDC is found by the issuer and subject of the ID token
+CREATE TABLE IF NOT EXISTS app.user_identities (
+  id          SERIAL        PRIMARY KEY,
+  userID      INT           NOT NULL,
+  issuer      VARCHAR(256)  NOT NULL,
+  subject     VARCHAR(256)  NOT NULL,
+  createdat   TIMESTAMP     NOT NULL,
+  UNIQUE (issuer, subject),
+  FOREIGN KEY (userID) REFERENCES app.users(id) ON DELETE CASCADE
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS app.usersessions_userid_idx;
+ALTER TABLE app.usersessions DROP COLUMN IF EXISTS lastSeenAt;
@@ -0,0 +1,7 @@
+-- Sessions expire once they are not used for the session lifetime, and are
+-- listed by user
+ALTER TABLE app.usersessions ADD COLUMN IF NOT EXISTS lastSeenAt TIMESTAMP;
+UPDATE app.usersessions SET lastSeenAt = LoginTime WHERE lastSeenAt IS NULL;
+ALTER TABLE app.usersessions ALTER COLUMN lastSeenAt SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS usersessions_userid_idx ON app.usersessions (userID);
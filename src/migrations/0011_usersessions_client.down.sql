@@ -0,0 +1,2 @@
+ALTER TABLE app.usersessions DROP COLUMN IF EXISTS ipAddress;
+ALTER TABLE app.usersessions DROP COLUMN IF EXISTS userAgent;
@@ -0,0 +1,3 @@
+-- The client a session was opened from, shown to its user
+ALTER TABLE app.usersessions ADD COLUMN IF NOT EXISTS userAgent VARCHAR(512) NOT NULL DEFAULT '';
+ALTER TABLE app.usersessions ADD COLUMN IF NOT EXISTS ipAddress VARCHAR(64) NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+ALTER TABLE app.refresh_tokens DROP COLUMN IF EXISTS ipAddress;
+ALTER TABLE app.refresh_tokens DROP COLUMN IF EXISTS userAgent;
@@ -0,0 +1,4 @@
+-- The client a JWT session was opened from, every refresh token of a family
+-- keeps it so the session can be shown to its user
+ALTER TABLE app.refresh_tokens ADD COLUMN IF NOT EXISTS userAgent VARCHAR(512) NOT NULL DEFAULT '';
+ALTER TABLE app.refresh_tokens ADD COLUMN IF NOT EXISTS ipAddress VARCHAR(64) NOT NULL DEFAULT '';
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const msgpackMediaType = "application/msgpack"
+
+// responseEncoder writes a response body in one media type.
+type responseEncoder struct {
+	mediaType string
+	encode    func(w io.Writer, v interface{}) error
+}
+
+// responseEncoders are the media types read endpoints can answer with, the
+// first one being used when the client accepts any of them equally.
+var responseEncoders = []responseEncoder{
+	{"application/json", encodeJSON},
+	{"application/xml", encodeXML},
+	{csvMediaType, encodeCSV},
+	{msgpackMediaType, encodeMsgpack},
+}
+
+// mediaTypeAliases maps other names clients use to a supported media type.
+var mediaTypeAliases = map[string]string{
+	"text/xml":              "application/xml",
+	"application/x-msgpack": msgpackMediaType,
+}
+
+type acceptedType struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept returns the media ranges of an Accept header, most preferred
+// first. A missing header accepts anything.
+func parseAccept(header string) []acceptedType {
+	if len(strings.TrimSpace(header)) == 0 {
+		return []acceptedType{{"*/*", 1}}
+	}
+
+	accepted := []acceptedType{}
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if val, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(val, 64)
+			if err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		if alias, ok := mediaTypeAliases[mediaType]; ok {
+			mediaType = alias
+		}
+		accepted = append(accepted, acceptedType{mediaType, q})
+	}
+
+	// More specific ranges win over wildcards of the same quality
+	specificity := func(mediaType string) int {
+		switch {
+		case mediaType == "*/*":
+			return 0
+		case strings.HasSuffix(mediaType, "/*"):
+			return 1
+		default:
+			return 2
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool {
+		if accepted[i].q != accepted[j].q {
+			return accepted[i].q > accepted[j].q
+		}
+		return specificity(accepted[i].mediaType) > specificity(accepted[j].mediaType)
+	})
+
+	return accepted
+}
+
+func mediaTypeMatches(mediaRange, mediaType string) bool {
+	if mediaRange == "*/*" || mediaRange == mediaType {
+		return true
+	}
+	return strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*"))
+}
+
+// negotiateEncoder picks the encoder of the media type the Accept header of
+// r prefers. It returns false when no supported type is acceptable.
+func negotiateEncoder(r *http.Request) (responseEncoder, bool) {
+	accepted := parseAccept(r.Header.Get("Accept"))
+
+	// A media type explicitly refused with q=0 is not acceptable even when
+	// a wildcard allows it
+	refused := map[string]bool{}
+	for _, a := range accepted {
+		if a.q == 0 && !strings.Contains(a.mediaType, "*") {
+			refused[a.mediaType] = true
+		}
+	}
+
+	for _, a := range accepted {
+		if a.q == 0 {
+			continue
+		}
+		for _, encoder := range responseEncoders {
+			if mediaTypeMatches(a.mediaType, encoder.mediaType) && !refused[encoder.mediaType] {
+				return encoder, true
+			}
+		}
+	}
+
+	return responseEncoder{}, false
+}
+
+// prefersMediaType reports whether mediaType is the most preferred media
+// type of the Accept header of r, for representations only some endpoints
+// have.
+func prefersMediaType(r *http.Request, mediaType string) bool {
+	accepted := parseAccept(r.Header.Get("Accept"))
+	return len(accepted) != 0 && accepted[0].q != 0 && accepted[0].mediaType == mediaType
+}
+
+// writeResponse encodes v in the media type negotiated with the Accept
+// header, answering 406 when none of the supported ones is acceptable.
+func writeResponse(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Add("Vary", "Accept")
+
+	encoder, ok := negotiateEncoder(r)
+	if !ok {
+		writeNotAcceptable(w)
+		return
+	}
+
+	writeEncoded(w, r, status, encoder, v)
+}
+
+func writeNotAcceptable(w http.ResponseWriter) {
+	supported := []string{}
+	for _, encoder := range responseEncoders {
+		supported = append(supported, encoder.mediaType)
+	}
+	http.Error(w, fmt.Sprintf("none of the accepted media types is supported, use one of %s", strings.Join(supported, ", ")),
+		http.StatusNotAcceptable)
+}
+
+// writeEncoded encodes v with encoder, for responses whose media type was
+// already chosen.
+func writeEncoded(w http.ResponseWriter, r *http.Request, status int, encoder responseEncoder, v interface{}) {
+	var buf bytes.Buffer
+	if err := encoder.encode(&buf, v); err != nil {
+		loggerFrom(r.Context()).Error("could not encode response", "media_type", encoder.mediaType, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", encoder.mediaType)
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+func encodeJSON(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func encodeMsgpack(w io.Writer, v interface{}) error {
+	encoder := msgpack.NewEncoder(w)
+	encoder.SetCustomStructTag("json")
+	return encoder.Encode(v)
+}
+
+// xmlList is the root element of lists, each item being an element named
+// by its XMLName field or else after its type, e.g.
+// <list><recipe>...</recipe></list>.
+type xmlList []interface{}
+
+func (list xmlList) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Name.Local = "list"
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, item := range list {
+		if err := e.Encode(item); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+func encodeXML(w io.Writer, v interface{}) error {
+	value := reflect.ValueOf(v)
+	if value.Kind() == reflect.Slice {
+		list := xmlList{}
+		for i := 0; i < value.Len(); i++ {
+			list = append(list, value.Index(i).Interface())
+		}
+		v = list
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(v)
+}
+
+// encodeCSV writes a struct or a list of structs as CSV with a header row.
+// Columns are named after the json tags of the fields, nested struct fields
+// being flattened into columns named like old.name.
+func encodeCSV(w io.Writer, v interface{}) error {
+	value := reflect.ValueOf(v)
+	items := []reflect.Value{}
+	if value.Kind() == reflect.Slice {
+		for i := 0; i < value.Len(); i++ {
+			items = append(items, value.Index(i))
+		}
+	} else {
+		items = append(items, value)
+	}
+
+	var itemType reflect.Type
+	if value.Kind() == reflect.Slice {
+		itemType = value.Type().Elem()
+	} else {
+		itemType = value.Type()
+	}
+	for itemType.Kind() == reflect.Ptr {
+		itemType = itemType.Elem()
+	}
+	if itemType.Kind() != reflect.Struct {
+		return fmt.Errorf("can not encode %s as CSV", itemType)
+	}
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvHeader(itemType, "")); err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := writer.Write(csvRow(item)); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func isNestedStruct(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && t != timeType
+}
+
+func csvHeader(t reflect.Type, prefix string) []string {
+	header := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		switch {
+		case field.Anonymous && isNestedStruct(field.Type):
+			header = append(header, csvHeader(field.Type, prefix)...)
+		case isNestedStruct(field.Type):
+			header = append(header, csvHeader(field.Type, prefix+csvColumnName(field)+".")...)
+		default:
+			header = append(header, prefix+csvColumnName(field))
+		}
+	}
+	return header
+}
+
+// csvColumnName returns the json tag name of a field, or its Go name when it
+// has none.
+func csvColumnName(field reflect.StructField) string {
+	if name := strings.Split(field.Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+		return name
+	}
+	return field.Name
+}
+
+func csvRow(value reflect.Value) []string {
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		value = value.Elem()
+	}
+
+	row := []string{}
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		fieldValue := value.Field(i)
+		if isNestedStruct(field.Type) {
+			row = append(row, csvRow(fieldValue)...)
+		} else {
+			row = append(row, csvValue(fieldValue))
+		}
+	}
+	return row
+}
+
+// csvValue formats a field. Nil pointers are empty and the items of a
+// slice are separated by spaces.
+func csvValue(value reflect.Value) string {
+	switch {
+	case value.Kind() == reflect.Ptr:
+		if value.IsNil() {
+			return ""
+		}
+		return csvValue(value.Elem())
+	case value.Type() == timeType:
+		return value.Interface().(time.Time).Format(time.RFC3339)
+	case value.Kind() == reflect.Slice:
+		items := []string{}
+		for i := 0; i < value.Len(); i++ {
+			items = append(items, csvValue(value.Index(i)))
+		}
+		return strings.Join(items, " ")
+	}
+	return fmt.Sprint(value.Interface())
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// oidcCookieName is the cookie keeping the state of a login between
+// /auth/oidc/login and the callback.
+const oidcCookieName = "oidc_login"
+
+// oidcLoginMaxAge is how long a user has to log in at the provider, in
+// seconds.
+const oidcLoginMaxAge = 600
+
+var ErrOIDCStateInvalid = errors.New("oidc login state is missing or does not match")
+
+// Identity is a user at an OpenID Connect provider.
+type Identity struct {
+	Issuer  string
+	Subject string
+}
+
+// oidcClaims are the ID token claims used to create users.
+type oidcClaims struct {
+	Nonce             string `json:"nonce"`
+	PreferredUsername string `json:"preferred_username"`
+	Email             string `json:"email"`
+	Name              string `json:"name"`
+}
+
+// oidcLogin is the state of a login in progress, kept in a cookie.
+type oidcLogin struct {
+	State    string `json:"state"`
+	Verifier string `json:"verifier"`
+	Nonce    string `json:"nonce"`
+}
+
+// OIDCClient logs users in with the authorization code flow and PKCE. The
+// provider is discovered on first use, so the server starts while the
+// provider is unreachable.
+type OIDCClient struct {
+	config   OIDCConfig
+	lock     sync.Mutex
+	provider *oidc.Provider
+}
+
+func NewOIDCClient(config OIDCConfig) *OIDCClient {
+	return &OIDCClient{config: config}
+}
+
+func (client *OIDCClient) discover(ctx context.Context) (*oidc.Provider, error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	if client.provider == nil {
+		provider, err := oidc.NewProvider(ctx, client.config.Issuer)
+		if err != nil {
+			return nil, err
+		}
+		client.provider = provider
+	}
+
+	return client.provider, nil
+}
+
+func (client *OIDCClient) oauth2Config(provider *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     client.config.ClientID,
+		ClientSecret: client.config.ClientSecret,
+		RedirectURL:  client.config.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	}
+}
+
+// AuthCodeURL returns the URL of the provider to send the user to, with
+// the state to check at the callback.
+func (client *OIDCClient) AuthCodeURL(ctx context.Context) (string, oidcLogin, error) {
+	provider, err := client.discover(ctx)
+	if err != nil {
+		return "", oidcLogin{}, err
+	}
+
+	login := oidcLogin{Verifier: oauth2.GenerateVerifier()}
+	if login.State, err = randomHex(16); err != nil {
+		return "", login, err
+	}
+	if login.Nonce, err = randomHex(16); err != nil {
+		return "", login, err
+	}
+
+	url := client.oauth2Config(provider).AuthCodeURL(login.State, oauth2.S256ChallengeOption(login.Verifier), oidc.Nonce(login.Nonce))
+	return url, login, nil
+}
+
+// Exchange redeems the code of the callback and returns the user linked to
+// the identity of the ID token, creating them on their first login.
+func (client *OIDCClient) Exchange(ctx context.Context, login oidcLogin, code string) (User, error) {
+	provider, err := client.discover(ctx)
+	if err != nil {
+		return User{}, err
+	}
+
+	token, err := client.oauth2Config(provider).Exchange(ctx, code, oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		return User{}, err
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return User{}, fmt.Errorf("token response has no id_token")
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: client.config.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return User{}, err
+	}
+	claims := oidcClaims{}
+	if err := idToken.Claims(&claims); err != nil {
+		return User{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(login.Nonce)) != 1 {
+		return User{}, fmt.Errorf("id token nonce does not match")
+	}
+
+	identity := Identity{Issuer: idToken.Issuer, Subject: idToken.Subject}
+	return db.GetIdentityUser(ctx, identity, identityUsernames(identity, claims), claims.Name)
+}
+
+// identityUsernames are the usernames a new user of identity is created
+// with: the preferred one and, when it is taken, the same with a suffix
+// unique to the identity.
+func identityUsernames(identity Identity, claims oidcClaims) []string {
+	username := claims.PreferredUsername
+	if len(username) == 0 {
+		username = claims.Email
+	}
+	if len(username) == 0 {
+		username = identity.Subject
+	}
+	// Room for the suffix in the 128 characters of a username
+	if runes := []rune(username); len(runes) > 119 {
+		username = string(runes[:119])
+	}
+
+	sum := sha256.Sum256([]byte(identity.Issuer + " " + identity.Subject))
+	return []string{username, username + "-" + hex.EncodeToString(sum[:4])}
+}
+
+// loginCookie is the login cookie, without value. It is scoped to the path
+// of the configured redirect URL, which is the one the provider sends the
+// user back to, and is Secure when that URL is https. TLS is often ended by
+// a proxy, so the request itself does not tell.
+func (client *OIDCClient) loginCookie() *http.Cookie {
+	cookie := &http.Cookie{Name: oidcCookieName, HttpOnly: true, SameSite: http.SameSiteLaxMode}
+	if redirectURL, err := url.Parse(client.config.RedirectURL); err == nil {
+		cookie.Path = redirectURL.EscapedPath()
+		cookie.Secure = redirectURL.Scheme == "https"
+	}
+	return cookie
+}
+
+// setLoginCookie keeps the state of a login until the callback. It is only
+// sent to the callback.
+func (client *OIDCClient) setLoginCookie(w http.ResponseWriter, login oidcLogin) error {
+	b, err := json.Marshal(login)
+	if err != nil {
+		return err
+	}
+
+	cookie := client.loginCookie()
+	cookie.Value = base64.RawURLEncoding.EncodeToString(b)
+	cookie.MaxAge = oidcLoginMaxAge
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+// loginFromCookie returns the login of the callback, checking its state
+// against the state parameter, and removes the cookie.
+func (client *OIDCClient) loginFromCookie(w http.ResponseWriter, r *http.Request) (oidcLogin, error) {
+	login := oidcLogin{}
+	cookie, err := r.Cookie(oidcCookieName)
+	if err != nil {
+		return login, ErrOIDCStateInvalid
+	}
+	expired := client.loginCookie()
+	expired.MaxAge = -1
+	http.SetCookie(w, expired)
+
+	b, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || json.Unmarshal(b, &login) != nil {
+		return login, ErrOIDCStateInvalid
+	}
+	state := r.FormValue("state")
+	if len(login.State) == 0 || subtle.ConstantTimeCompare([]byte(state), []byte(login.State)) != 1 {
+		return login, ErrOIDCStateInvalid
+	}
+
+	return login, nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,662 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// jsonSchema is a JSON Schema (draft 2020-12, as used by OpenAPI 3.1).
+type jsonSchema map[string]interface{}
+
+type OpenAPIDocument struct {
+	OpenAPI    string                     `json:"openapi"`
+	Info       OpenAPIInfo                `json:"info"`
+	Paths      map[string]OpenAPIPathItem `json:"paths"`
+	Components OpenAPIComponents          `json:"components"`
+}
+
+type OpenAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+// OpenAPIPathItem holds the operations of a path by lower case method.
+type OpenAPIPathItem map[string]*OpenAPIOperation
+
+type OpenAPIOperation struct {
+	Summary     string                     `json:"summary"`
+	Description string                     `json:"description,omitempty"`
+	Tags        []string                   `json:"tags,omitempty"`
+	Deprecated  bool                       `json:"deprecated,omitempty"`
+	Security    []map[string][]string      `json:"security,omitempty"`
+	Parameters  []OpenAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *OpenAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]OpenAPIResponse `json:"responses"`
+}
+
+type OpenAPIParameter struct {
+	Name        string     `json:"name"`
+	In          string     `json:"in"`
+	Description string     `json:"description,omitempty"`
+	Required    bool       `json:"required,omitempty"`
+	Schema      jsonSchema `json:"schema"`
+}
+
+type OpenAPIRequestBody struct {
+	Required bool                        `json:"required,omitempty"`
+	Content  map[string]OpenAPIMediaType `json:"content"`
+}
+
+type OpenAPIMediaType struct {
+	Schema jsonSchema `json:"schema"`
+}
+
+type OpenAPIResponse struct {
+	Description string                      `json:"description"`
+	Headers     map[string]OpenAPIHeader    `json:"headers,omitempty"`
+	Content     map[string]OpenAPIMediaType `json:"content,omitempty"`
+}
+
+type OpenAPIHeader struct {
+	Description string     `json:"description,omitempty"`
+	Schema      jsonSchema `json:"schema"`
+}
+
+type OpenAPIComponents struct {
+	Schemas         map[string]jsonSchema `json:"schemas"`
+	SecuritySchemes map[string]jsonSchema `json:"securitySchemes"`
+}
+
+// OpenAPIHandler serves the OpenAPI document of every API version.
+func OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, err := json.Marshal(openAPIDocument())
+	if err != nil {
+		loggerFrom(r.Context()).Error("could not encode OpenAPI document", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// openAPIDocument describes the operational endpoints and the routes of
+// every API version. The unprefixed aliases of /v1 are documented as
+// deprecated copies of its operations.
+func openAPIDocument() OpenAPIDocument {
+	doc := OpenAPIDocument{
+		OpenAPI: "3.1.0",
+		Info:    OpenAPIInfo{Title: "recipe-api", Version: buildCommit},
+		Paths:   map[string]OpenAPIPathItem{},
+		Components: OpenAPIComponents{
+			Schemas: map[string]jsonSchema{
+				"Recipe":         schemaOf(reflect.TypeOf(RecipeV1{})),
+				"DeletedRecipe":  schemaOf(reflect.TypeOf(DeletedRecipeV1{})),
+				"RecipeFields":   schemaOf(reflect.TypeOf(RecipeFieldsV1{})),
+				"RecipeRevision": schemaOf(reflect.TypeOf(RecipeRevisionV1{})),
+				"FieldChange":    schemaOf(reflect.TypeOf(FieldChangeV1{})),
+				"ImportResult":   schemaOf(reflect.TypeOf(ImportResult{})),
+				"VersionInfo":    schemaOf(reflect.TypeOf(VersionInfo{})),
+				"APIKey":         schemaOf(reflect.TypeOf(APIKeyV1{})),
+				"CreatedAPIKey":  schemaOf(reflect.TypeOf(CreatedAPIKeyV1{})),
+				"Session":        schemaOf(reflect.TypeOf(SessionV1{})),
+				"Tokens":         schemaOf(reflect.TypeOf(TokensV1{})),
+				"SearchQuery":    searchQuerySchema,
+			},
+			SecuritySchemes: map[string]jsonSchema{
+				"session":     {"type": "apiKey", "in": "cookie", "name": sessionCookieName()},
+				"apiKey":      {"type": "http", "scheme": "bearer", "description": "Personal API key, allowed the scopes " + strings.Join(apiKeyScopes, ", ")},
+				"accessToken": {"type": "http", "scheme": "bearer", "bearerFormat": "JWT", "description": "Access token of the jwt session mode"},
+			},
+		},
+	}
+
+	for path, item := range operationalPaths() {
+		doc.Paths[path] = item
+	}
+	for _, version := range apiVersions {
+		for path, item := range version.paths() {
+			doc.Paths[version.prefix+path] = item
+		}
+	}
+	for path, item := range v1Paths() {
+		deprecated := OpenAPIPathItem{}
+		for method, operation := range item {
+			copied := *operation
+			copied.Deprecated = true
+			copied.Description = strings.TrimSpace("Deprecated alias of " + v1Prefix + path + ". " + copied.Description)
+			deprecated[method] = &copied
+		}
+		doc.Paths[path] = deprecated
+	}
+
+	return doc
+}
+
+func sessionCookieName() string {
+	if len(config.Session.CookieSID) != 0 {
+		return config.Session.CookieSID
+	}
+	return "sid"
+}
+
+func operationalPaths() map[string]OpenAPIPathItem {
+	return map[string]OpenAPIPathItem{
+		"/healthz": {"get": {
+			Summary:   "Liveness check",
+			Tags:      []string{"operations"},
+			Responses: map[string]OpenAPIResponse{"200": textResponse("The process is up")},
+		}},
+		"/readyz": {"get": {
+			Summary: "Readiness check",
+			Tags:    []string{"operations"},
+			Responses: map[string]OpenAPIResponse{
+				"200": textResponse("The database and session store are reachable and migrations are applied"),
+				"503": errorResponse(http.StatusServiceUnavailable),
+			},
+		}},
+		"/version": {"get": {
+			Summary:   "Build and schema versions",
+			Tags:      []string{"operations"},
+			Responses: map[string]OpenAPIResponse{"200": negotiatedResponse("Versions", schemaRef("VersionInfo")), "406": errorResponse(http.StatusNotAcceptable)},
+		}},
+		"/metrics": {"get": {
+			Summary:   "Prometheus metrics",
+			Tags:      []string{"operations"},
+			Responses: map[string]OpenAPIResponse{"200": textResponse("Metrics in the Prometheus text format")},
+		}},
+		"/openapi.json": {"get": {
+			Summary: "This document",
+			Tags:    []string{"operations"},
+			Responses: map[string]OpenAPIResponse{"200": {
+				Description: "OpenAPI document",
+				Content:     map[string]OpenAPIMediaType{"application/json": {Schema: jsonSchema{"type": "object"}}},
+			}},
+		}},
+	}
+}
+
+// v1Paths documents the routes registered by registerV1Routes, without the
+// version prefix.
+func v1Paths() map[string]OpenAPIPathItem {
+	recipeID := pathParameter("id", "Recipe ID")
+	ifMatch := OpenAPIParameter{Name: "If-Match", In: "header", Description: "ETag the recipe must still have, required when REQUIRE_IF_MATCH is set", Schema: jsonSchema{"type": "string"}}
+	recipeFieldsBody := &OpenAPIRequestBody{Required: true, Content: map[string]OpenAPIMediaType{
+		"application/json":                  {Schema: schemaRef("RecipeFields")},
+		"application/x-www-form-urlencoded": {Schema: schemaRef("RecipeFields")},
+	}}
+	searchQuery := OpenAPIParameter{Name: "query", In: "query", Description: "SearchQuery as JSON", Schema: jsonSchema{
+		"type":             "string",
+		"contentMediaType": "application/json",
+		"contentSchema":    schemaRef("SearchQuery"),
+	}}
+	requiredSearchQuery := searchQuery
+	requiredSearchQuery.Required = true
+	credentials := &OpenAPIRequestBody{Required: true, Content: map[string]OpenAPIMediaType{
+		"application/x-www-form-urlencoded": {Schema: jsonSchema{
+			"type":     "object",
+			"required": []string{"username", "password"},
+			"properties": jsonSchema{
+				"username": jsonSchema{"type": "string"},
+				"password": jsonSchema{"type": "string"},
+				"fullname": jsonSchema{"type": "string", "description": "Only used by register"},
+			},
+		}},
+	}}
+	apiKeyBody := &OpenAPIRequestBody{Required: true, Content: map[string]OpenAPIMediaType{
+		"application/json": {Schema: jsonSchema{
+			"type":     "object",
+			"required": []string{"name", "scopes"},
+			"properties": jsonSchema{
+				"name":   jsonSchema{"type": "string", "maxLength": 128},
+				"scopes": arrayOf(jsonSchema{"enum": apiKeyScopes}),
+			},
+		}},
+		"application/x-www-form-urlencoded": {Schema: jsonSchema{
+			"type":     "object",
+			"required": []string{"name", "scopes"},
+			"properties": jsonSchema{
+				"name":   jsonSchema{"type": "string", "maxLength": 128},
+				"scopes": jsonSchema{"type": "string", "description": "Scopes separated by spaces or commas"},
+			},
+		}},
+	}}
+	updateErrors := []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusConflict,
+		http.StatusPreconditionFailed, http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity, http.StatusPreconditionRequired}
+
+	return map[string]OpenAPIPathItem{
+		"/register": {"post": {
+			Summary:     "Create a user",
+			Tags:        []string{"users"},
+			RequestBody: credentials,
+			Responses:   withErrors(map[string]OpenAPIResponse{"200": textResponse("User created")}, http.StatusBadRequest),
+		}},
+		"/login": {"post": {
+			Summary:     "Open a session",
+			Description: "Sets the session cookie, or in the jwt session mode returns an access token and a refresh token.",
+			Tags:        []string{"users"},
+			RequestBody: credentials,
+			Responses: withErrors(map[string]OpenAPIResponse{"200": {
+				Description: "Session opened",
+				Headers:     map[string]OpenAPIHeader{"Set-Cookie": {Schema: jsonSchema{"type": "string"}}},
+				Content:     negotiatedResponse("", schemaRef("Tokens")).Content,
+			}}, http.StatusBadRequest, http.StatusUnauthorized),
+		}},
+		"/logout": {"post": {
+			Summary:     "End the session",
+			Description: "In the jwt session mode the refresh token is revoked with every token refreshed from the same login.",
+			Tags:        []string{"users"},
+			Security:    sessionSecurity(),
+			RequestBody: refreshTokenBody(false),
+			Responses:   withErrors(map[string]OpenAPIResponse{"200": textResponse("Session ended")}, http.StatusBadRequest),
+		}},
+		"/auth/oidc/login": {"get": {
+			Summary:     "Log in with OpenID Connect",
+			Description: "Redirects to the identity provider, which redirects back to /auth/oidc/callback.",
+			Tags:        []string{"users"},
+			Responses: withErrors(map[string]OpenAPIResponse{"302": {
+				Description: "Redirect to the identity provider",
+				Headers:     map[string]OpenAPIHeader{"Location": {Schema: jsonSchema{"type": "string"}}},
+			}}, http.StatusNotFound, http.StatusBadGateway),
+		}},
+		"/auth/oidc/callback": {"get": {
+			Summary:     "Complete an OpenID Connect login",
+			Description: "Opens a session like /login of the user linked to the identity, created on their first login.",
+			Tags:        []string{"users"},
+			Parameters: []OpenAPIParameter{
+				queryParameter("code", "Authorization code", jsonSchema{"type": "string"}),
+				queryParameter("state", "State of the login", jsonSchema{"type": "string"}),
+				queryParameter("error", "Error of the identity provider", jsonSchema{"type": "string"}),
+			},
+			Responses: withErrors(map[string]OpenAPIResponse{
+				"200": negotiatedResponse("Tokens in the jwt session mode", schemaRef("Tokens")),
+				"302": {
+					Description: "Session opened",
+					Headers:     map[string]OpenAPIHeader{"Set-Cookie": {Schema: jsonSchema{"type": "string"}}},
+				},
+			}, http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound),
+		}},
+		"/token/refresh": {"post": {
+			Summary:     "Refresh the tokens of a jwt session",
+			Description: "Each refresh token can be used once. Using it again revokes every token refreshed from the same login.",
+			Tags:        []string{"users"},
+			RequestBody: refreshTokenBody(true),
+			Responses:   withErrors(map[string]OpenAPIResponse{"200": negotiatedResponse("New tokens", schemaRef("Tokens"))}, http.StatusBadRequest, http.StatusUnauthorized, http.StatusNotFound, http.StatusNotAcceptable),
+		}},
+		"/me/api-keys": {
+			"get": {
+				Summary:   "List your API keys",
+				Tags:      []string{"users"},
+				Security:  sessionSecurity(),
+				Responses: withErrors(map[string]OpenAPIResponse{"200": negotiatedResponse("Unrevoked API keys", arrayOf(schemaRef("APIKey")))}, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotAcceptable),
+			},
+			"post": {
+				Summary:     "Create an API key",
+				Description: "The key is only returned in this response.",
+				Tags:        []string{"users"},
+				Security:    sessionSecurity(),
+				RequestBody: apiKeyBody,
+				Responses: withErrors(map[string]OpenAPIResponse{"201": {
+					Description: "API key created",
+					Headers:     map[string]OpenAPIHeader{"Location": {Schema: jsonSchema{"type": "string"}}},
+					Content:     negotiatedResponse("", schemaRef("CreatedAPIKey")).Content,
+				}}, http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotAcceptable),
+			},
+		},
+		"/me/api-keys/{id}": {"delete": {
+			Summary:    "Revoke an API key",
+			Tags:       []string{"users"},
+			Security:   sessionSecurity(),
+			Parameters: []OpenAPIParameter{pathParameter("id", "API key ID")},
+			Responses:  withErrors(map[string]OpenAPIResponse{"204": {Description: "API key revoked"}}, http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound),
+		}},
+		"/me/sessions": {
+			"get": {
+				Summary:   "List your sessions",
+				Tags:      []string{"users"},
+				Security:  sessionSecurity(),
+				Responses: withErrors(map[string]OpenAPIResponse{"200": negotiatedResponse("Unexpired cookie sessions and jwt sessions, most recently seen first", arrayOf(schemaRef("Session")))}, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotAcceptable),
+			},
+			"delete": {
+				Summary:     "Log out everywhere",
+				Description: "Ends every session of the user, including the refresh tokens of jwt sessions. Access tokens stay valid until they expire.",
+				Tags:        []string{"users"},
+				Security:    sessionSecurity(),
+				Responses:   withErrors(map[string]OpenAPIResponse{"204": {Description: "Sessions ended"}}, http.StatusUnauthorized, http.StatusForbidden),
+			},
+		},
+		"/me/sessions/{id}": {"delete": {
+			Summary:     "End a session",
+			Description: "Ending a jwt session revokes its refresh tokens. Its access tokens stay valid until they expire.",
+			Tags:        []string{"users"},
+			Security:    sessionSecurity(),
+			Parameters:  []OpenAPIParameter{{Name: "id", In: "path", Description: "Session ID", Required: true, Schema: jsonSchema{"type": "string", "pattern": "^[0-9a-f]+$"}}},
+			Responses:   withErrors(map[string]OpenAPIResponse{"204": {Description: "Session ended"}}, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound),
+		}},
+		"/users/{id}/sessions": {"delete": {
+			Summary:     "End every session of a user",
+			Description: "Admins only. Ends the cookie sessions and the refresh tokens of jwt sessions of the user.",
+			Tags:        []string{"users"},
+			Security:    sessionSecurity(),
+			Parameters:  []OpenAPIParameter{pathParameter("id", "User ID")},
+			Responses:   withErrors(map[string]OpenAPIResponse{"204": {Description: "Sessions ended"}}, http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden),
+		}},
+		"/recipes": {
+			"get": {
+				Summary: "List recipes",
+				Tags:    []string{"recipes"},
+				Parameters: []OpenAPIParameter{
+					queryParameter("items", "Recipes per page", jsonSchema{"type": "integer", "minimum": 0}),
+					queryParameter("page", "Page number", jsonSchema{"type": "integer", "minimum": 0}),
+				},
+				Responses: withErrors(map[string]OpenAPIResponse{"200": negotiatedResponse("Recipes", arrayOf(schemaRef("Recipe")))}, http.StatusNotAcceptable),
+			},
+			"post": {
+				Summary:     "Create a recipe",
+				Tags:        []string{"recipes"},
+				Security:    recipesSecurity(scopeRecipesWrite),
+				RequestBody: recipeFieldsBody,
+				Responses:   withErrors(map[string]OpenAPIResponse{"200": textResponse("Recipe created")}, http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden),
+			},
+		},
+		"/recipes/import": {"post": {
+			Summary: "Import recipes",
+			Tags:    []string{"recipes"},
+			Parameters: []OpenAPIParameter{
+				queryParameter("mode", "atomic rejects the import when any row is invalid, partial imports the valid rows", jsonSchema{"enum": []string{"atomic", "partial"}}),
+				queryParameter("difficulty", "Difficulty of JSON-LD recipes", jsonSchema{"type": "integer", "minimum": 1, "maximum": 3}),
+			},
+			Security: recipesSecurity(scopeRecipesWrite),
+			RequestBody: &OpenAPIRequestBody{Required: true, Content: map[string]OpenAPIMediaType{
+				csvMediaType:    {Schema: jsonSchema{"type": "string"}},
+				jsonlMediaType:  {Schema: jsonSchema{"type": "string"}},
+				jsonldMediaType: {Schema: jsonSchema{"type": "object"}},
+			}},
+			Responses: withErrors(map[string]OpenAPIResponse{
+				"200": negotiatedResponse("Import result", schemaRef("ImportResult")),
+				"422": negotiatedResponse("Atomic import rejected, nothing was imported", schemaRef("ImportResult")),
+			}, http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusUnsupportedMediaType, http.StatusNotAcceptable),
+		}},
+		"/recipes/export": {"get": {
+			Summary: "Export recipes",
+			Tags:    []string{"recipes"},
+			Parameters: []OpenAPIParameter{
+				queryParameter("format", "Export format", jsonSchema{"enum": []string{"csv", "jsonl"}}),
+				searchQuery,
+			},
+			Responses: withErrors(map[string]OpenAPIResponse{"200": {
+				Description: "Recipes",
+				Content: map[string]OpenAPIMediaType{
+					csvMediaType:   {Schema: jsonSchema{"type": "string"}},
+					jsonlMediaType: {Schema: jsonSchema{"type": "string"}},
+				},
+			}}, http.StatusBadRequest),
+		}},
+		"/recipes/{id}": {
+			"get": {
+				Summary: "Get a recipe",
+				Tags:    []string{"recipes"},
+				Parameters: []OpenAPIParameter{
+					recipeID,
+					queryParameter("format", "jsonld returns a schema.org Recipe, json the API representation, whatever the Accept header", jsonSchema{"enum": []string{"json", "jsonld"}}),
+					{Name: "If-None-Match", In: "header", Schema: jsonSchema{"type": "string"}},
+				},
+				Responses: withErrors(map[string]OpenAPIResponse{
+					"200": withContent(negotiatedResponse("Recipe in a list of one", arrayOf(schemaRef("Recipe"))), jsonldMediaType, jsonSchema{"type": "object"}),
+					"304": {Description: "Not Modified"},
+				}, http.StatusBadRequest, http.StatusNotFound, http.StatusNotAcceptable),
+			},
+			"put": {
+				Summary:     "Replace a recipe",
+				Tags:        []string{"recipes"},
+				Security:    recipesSecurity(scopeRecipesWrite),
+				Parameters:  []OpenAPIParameter{recipeID, ifMatch},
+				RequestBody: recipeFieldsBody,
+				Responses:   withErrors(map[string]OpenAPIResponse{"200": textResponse("Recipe replaced")}, updateErrors...),
+			},
+			"patch": {
+				Summary:    "Update some fields of a recipe",
+				Tags:       []string{"recipes"},
+				Security:   recipesSecurity(scopeRecipesWrite),
+				Parameters: []OpenAPIParameter{recipeID, ifMatch},
+				RequestBody: &OpenAPIRequestBody{Required: true, Content: map[string]OpenAPIMediaType{
+					mergePatchMediaType:                 {Schema: jsonSchema{"type": "object"}},
+					jsonPatchMediaType:                  {Schema: jsonSchema{"type": "array", "items": jsonSchema{"type": "object"}}},
+					"application/x-www-form-urlencoded": {Schema: jsonSchema{"type": "object"}},
+				}},
+				Responses: withErrors(map[string]OpenAPIResponse{"200": textResponse("Recipe updated")}, updateErrors...),
+			},
+			"delete": {
+				Summary:  "Delete a recipe",
+				Tags:     []string{"recipes"},
+				Security: recipesSecurity(scopeRecipesWrite),
+				Parameters: []OpenAPIParameter{
+					recipeID,
+					ifMatch,
+					queryParameter("permanent", "Delete permanently instead of moving to the trash, admins only", jsonSchema{"type": "boolean"}),
+				},
+				Responses: withErrors(map[string]OpenAPIResponse{"200": textResponse("Recipe deleted")},
+					http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusPreconditionFailed, http.StatusPreconditionRequired),
+			},
+		},
+		"/recipes/{id}/rate": {
+			"put":   rateOperation(recipeID),
+			"patch": rateOperation(recipeID),
+		},
+		"/recipes/{id}/restore": {"post": {
+			Summary:     "Restore a recipe from the trash",
+			Description: "Admins only.",
+			Tags:        []string{"trash"},
+			Security:    recipesSecurity(scopeRecipesWrite),
+			Parameters:  []OpenAPIParameter{recipeID},
+			Responses:   withErrors(map[string]OpenAPIResponse{"200": textResponse("Recipe restored")}, http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound),
+		}},
+		"/recipes/{id}/revisions": {"get": {
+			Summary:    "List the revisions of a recipe",
+			Tags:       []string{"revisions"},
+			Security:   recipesSecurity(scopeRecipesRead),
+			Parameters: []OpenAPIParameter{recipeID},
+			Responses: withErrors(map[string]OpenAPIResponse{"200": negotiatedResponse("Revisions", arrayOf(schemaRef("RecipeRevision")))},
+				http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusNotAcceptable),
+		}},
+		"/recipes/{id}/revisions/diff": {"get": {
+			Summary:  "List the fields changed between two revisions",
+			Tags:     []string{"revisions"},
+			Security: recipesSecurity(scopeRecipesRead),
+			Parameters: []OpenAPIParameter{
+				recipeID,
+				{Name: "from", In: "query", Required: true, Schema: jsonSchema{"type": "integer", "minimum": 0}},
+				{Name: "to", In: "query", Required: true, Schema: jsonSchema{"type": "integer", "minimum": 0}},
+			},
+			Responses: withErrors(map[string]OpenAPIResponse{"200": negotiatedResponse("Changed fields", arrayOf(schemaRef("FieldChange")))},
+				http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusNotAcceptable),
+		}},
+		"/recipes/{id}/revisions/{revision}/revert": {"post": {
+			Summary:    "Set a recipe back to a revision",
+			Tags:       []string{"revisions"},
+			Security:   recipesSecurity(scopeRecipesWrite),
+			Parameters: []OpenAPIParameter{recipeID, pathParameter("revision", "Revision number, 0 being the recipe as created"), ifMatch},
+			Responses: withErrors(map[string]OpenAPIResponse{"200": negotiatedResponse("The revision recording the revert", schemaRef("RecipeRevision"))},
+				http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusPreconditionFailed, http.StatusPreconditionRequired, http.StatusNotAcceptable),
+		}},
+		"/trash": {"get": {
+			Summary:   "List deleted recipes",
+			Tags:      []string{"trash"},
+			Security:  recipesSecurity(scopeRecipesRead),
+			Responses: withErrors(map[string]OpenAPIResponse{"200": negotiatedResponse("Deleted recipes", arrayOf(schemaRef("DeletedRecipe")))}, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotAcceptable),
+		}},
+		"/search": {"get": {
+			Summary:    "Search recipes",
+			Tags:       []string{"recipes"},
+			Parameters: []OpenAPIParameter{requiredSearchQuery},
+			Responses:  withErrors(map[string]OpenAPIResponse{"200": negotiatedResponse("Matching recipes", arrayOf(schemaRef("Recipe")))}, http.StatusBadRequest, http.StatusNotAcceptable),
+		}},
+	}
+}
+
+func rateOperation(recipeID OpenAPIParameter) *OpenAPIOperation {
+	return &OpenAPIOperation{
+		Summary:    "Rate a recipe",
+		Tags:       []string{"recipes"},
+		Parameters: []OpenAPIParameter{recipeID},
+		RequestBody: &OpenAPIRequestBody{Required: true, Content: map[string]OpenAPIMediaType{
+			"application/x-www-form-urlencoded": {Schema: jsonSchema{
+				"type":       "object",
+				"required":   []string{"rating"},
+				"properties": jsonSchema{"rating": jsonSchema{"type": "integer", "minimum": 1, "maximum": 5}},
+			}},
+		}},
+		Responses: withErrors(map[string]OpenAPIResponse{"200": {Description: "Recipe rated"}}, http.StatusBadRequest, http.StatusNotFound),
+	}
+}
+
+// sessionSecurity allows a session cookie or an access token.
+func sessionSecurity() []map[string][]string {
+	return []map[string][]string{{"session": {}}, {"accessToken": {}}}
+}
+
+// recipesSecurity allows a session or an API key with scope.
+func recipesSecurity(scope string) []map[string][]string {
+	return append(sessionSecurity(), map[string][]string{"apiKey": {scope}})
+}
+
+func refreshTokenBody(required bool) *OpenAPIRequestBody {
+	schema := jsonSchema{
+		"type":       "object",
+		"properties": jsonSchema{"refresh_token": jsonSchema{"type": "string"}},
+	}
+	if required {
+		schema["required"] = []string{"refresh_token"}
+	}
+	return &OpenAPIRequestBody{Required: required, Content: map[string]OpenAPIMediaType{
+		"application/json":                  {Schema: schema},
+		"application/x-www-form-urlencoded": {Schema: schema},
+	}}
+}
+
+func pathParameter(name, description string) OpenAPIParameter {
+	return OpenAPIParameter{Name: name, In: "path", Description: description, Required: true, Schema: jsonSchema{"type": "integer", "minimum": 0}}
+}
+
+func queryParameter(name, description string, schema jsonSchema) OpenAPIParameter {
+	return OpenAPIParameter{Name: name, In: "query", Description: description, Schema: schema}
+}
+
+func schemaRef(name string) jsonSchema {
+	return jsonSchema{"$ref": "#/components/schemas/" + name}
+}
+
+func arrayOf(items jsonSchema) jsonSchema {
+	return jsonSchema{"type": "array", "items": items}
+}
+
+func textResponse(description string) OpenAPIResponse {
+	return OpenAPIResponse{
+		Description: description,
+		Content:     map[string]OpenAPIMediaType{"text/plain": {Schema: jsonSchema{"type": "string"}}},
+	}
+}
+
+// negotiatedResponse is a response written by writeResponse, in any of the
+// media types of responseEncoders.
+func negotiatedResponse(description string, schema jsonSchema) OpenAPIResponse {
+	response := OpenAPIResponse{Description: description, Content: map[string]OpenAPIMediaType{}}
+	for _, encoder := range responseEncoders {
+		response.Content[encoder.mediaType] = OpenAPIMediaType{Schema: schema}
+	}
+	return response
+}
+
+func withContent(response OpenAPIResponse, mediaType string, schema jsonSchema) OpenAPIResponse {
+	response.Content[mediaType] = OpenAPIMediaType{Schema: schema}
+	return response
+}
+
+// errorResponse documents an error status, answered with a plain text
+// message or no body.
+func errorResponse(status int) OpenAPIResponse {
+	return textResponse(http.StatusText(status))
+}
+
+// withErrors adds the given error statuses and the ones every endpoint can
+// answer with to responses.
+func withErrors(responses map[string]OpenAPIResponse, statuses ...int) map[string]OpenAPIResponse {
+	for _, status := range append(statuses, http.StatusMethodNotAllowed, http.StatusInternalServerError) {
+		responses[strconv.Itoa(status)] = errorResponse(status)
+	}
+	return responses
+}
+
+var timeReflectType = reflect.TypeOf(time.Time{})
+
+// schemaOf returns the JSON Schema of the JSON encoding of t. Members
+// without omitempty are required.
+func schemaOf(t reflect.Type) jsonSchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeReflectType:
+		return jsonSchema{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Struct:
+		properties, required := jsonSchema{}, []string{}
+		addStructProperties(t, properties, &required)
+		sort.Strings(required)
+		return jsonSchema{"type": "object", "properties": properties, "required": required}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return arrayOf(schemaOf(t.Elem()))
+	case t.Kind() == reflect.Map:
+		return jsonSchema{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+	case t.Kind() == reflect.Bool:
+		return jsonSchema{"type": "boolean"}
+	case t.Kind() == reflect.String:
+		return jsonSchema{"type": "string"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return jsonSchema{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return jsonSchema{"type": "number"}
+	}
+	return jsonSchema{}
+}
+
+func addStructProperties(t reflect.Type, properties jsonSchema, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("json"), ",")
+		if field.PkgPath != "" || tag[0] == "-" {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct && len(tag[0]) == 0 {
+			addStructProperties(field.Type, properties, required)
+			continue
+		}
+
+		name := tag[0]
+		if len(name) == 0 {
+			name = field.Name
+		}
+		properties[name] = schemaOf(field.Type)
+		if field.Type.Kind() == reflect.Ptr {
+			properties[name] = jsonSchema{"anyOf": []jsonSchema{schemaOf(field.Type), {"type": "null"}}}
+		}
+
+		omitempty := false
+		for _, option := range tag[1:] {
+			omitempty = omitempty || option == "omitempty"
+		}
+		if !omitempty {
+			*required = append(*required, name)
+		}
+	}
+}
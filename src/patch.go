@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	mergePatchMediaType = "application/merge-patch+json"
+	jsonPatchMediaType  = "application/json-patch+json"
+)
+
+// ErrPatchTestFailed is returned when a JSON Patch test operation does not
+// match the document.
+var ErrPatchTestFailed = errors.New("patch test operation failed")
+
+// PatchError is returned when a well formed patch can not be applied to the
+// document, e.g. when a path does not exist.
+type PatchError struct {
+	Message string
+}
+
+func (err *PatchError) Error() string {
+	return err.Message
+}
+
+func patchErrorf(format string, args ...interface{}) error {
+	return &PatchError{fmt.Sprintf(format, args...)}
+}
+
+// DocumentPatch changes a generic JSON document as decoded by encoding/json.
+type DocumentPatch interface {
+	Apply(doc interface{}) (interface{}, error)
+}
+
+// MergePatch is a JSON Merge Patch (RFC 7396).
+type MergePatch struct {
+	Patch interface{}
+}
+
+func ParseMergePatch(b []byte) (MergePatch, error) {
+	patch := MergePatch{}
+	if err := json.Unmarshal(b, &patch.Patch); err != nil {
+		return patch, fmt.Errorf("merge patch is not valid JSON: %s", err)
+	}
+	return patch, nil
+}
+
+func (patch MergePatch) Apply(doc interface{}) (interface{}, error) {
+	return mergePatch(doc, patch.Patch), nil
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = map[string]interface{}{}
+	}
+	for key, value := range patchObj {
+		if value == nil {
+			delete(targetObj, key)
+		} else {
+			targetObj[key] = mergePatch(targetObj[key], value)
+		}
+	}
+
+	return targetObj
+}
+
+// PatchOperation is one operation of a JSON Patch. Path and From are parsed
+// JSON pointers.
+type PatchOperation struct {
+	Op    string
+	Path  []string
+	From  []string
+	Value interface{}
+}
+
+// JSONPatch is a JSON Patch (RFC 6902), its operations are applied in order.
+type JSONPatch []PatchOperation
+
+// ParseJSONPatch decodes a JSON Patch, checking every operation has the
+// members its op requires.
+func ParseJSONPatch(b []byte) (JSONPatch, error) {
+	raw := []map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("JSON patch must be an array of operations: %s", err)
+	}
+
+	patch := JSONPatch{}
+	for i, members := range raw {
+		op := PatchOperation{}
+		if err := json.Unmarshal(members["op"], &op.Op); err != nil {
+			return nil, fmt.Errorf("operation %d: op is not valid", i)
+		}
+
+		var path string
+		if err := json.Unmarshal(members["path"], &path); err != nil {
+			return nil, fmt.Errorf("operation %d: path is not set", i)
+		}
+		var err error
+		if op.Path, err = parsePointer(path); err != nil {
+			return nil, fmt.Errorf("operation %d: %s", i, err)
+		}
+
+		switch op.Op {
+		case "add", "replace", "test":
+			value, ok := members["value"]
+			if !ok {
+				return nil, fmt.Errorf("operation %d: value is not set", i)
+			}
+			if err := json.Unmarshal(value, &op.Value); err != nil {
+				return nil, fmt.Errorf("operation %d: value is not valid", i)
+			}
+		case "move", "copy":
+			var from string
+			if err := json.Unmarshal(members["from"], &from); err != nil {
+				return nil, fmt.Errorf("operation %d: from is not set", i)
+			}
+			if op.From, err = parsePointer(from); err != nil {
+				return nil, fmt.Errorf("operation %d: %s", i, err)
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("operation %d: unknown op %q", i, op.Op)
+		}
+
+		patch = append(patch, op)
+	}
+
+	return patch, nil
+}
+
+func (patch JSONPatch) Apply(doc interface{}) (interface{}, error) {
+	var err error
+	for _, op := range patch {
+		switch op.Op {
+		case "add":
+			doc, err = pointerAdd(doc, op.Path, op.Value)
+		case "remove":
+			doc, _, err = pointerRemove(doc, op.Path)
+		case "replace":
+			if _, err = pointerGet(doc, op.Path); err == nil {
+				doc, err = pointerReplace(doc, op.Path, op.Value)
+			}
+		case "move":
+			if isPointerPrefix(op.From, op.Path) && len(op.From) != len(op.Path) {
+				return nil, patchErrorf("can not move %s into itself", formatPointer(op.From))
+			}
+			var value interface{}
+			if doc, value, err = pointerRemove(doc, op.From); err == nil {
+				doc, err = pointerAdd(doc, op.Path, value)
+			}
+		case "copy":
+			var value interface{}
+			if value, err = pointerGet(doc, op.From); err == nil {
+				doc, err = pointerAdd(doc, op.Path, deepCopy(value))
+			}
+		case "test":
+			var value interface{}
+			if value, err = pointerGet(doc, op.Path); err == nil && !reflect.DeepEqual(value, op.Value) {
+				err = ErrPatchTestFailed
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return doc, nil
+}
+
+// parsePointer splits a JSON pointer (RFC 6901) into its unescaped tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if len(pointer) == 0 {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("JSON pointer %q must start with /", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func formatPointer(tokens []string) string {
+	pointer := ""
+	for _, token := range tokens {
+		pointer += "/" + strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+	}
+	return pointer
+}
+
+func isPointerPrefix(prefix, tokens []string) bool {
+	if len(prefix) > len(tokens) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != tokens[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// arrayIndex parses an array index token, "-" being one past the end when
+// allowed.
+func arrayIndex(token string, length int, allowEnd bool) (int, bool) {
+	if token == "-" && allowEnd {
+		return length, true
+	}
+	if len(token) == 0 || (len(token) > 1 && token[0] == '0') {
+		return 0, false
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || index > length || (index == length && !allowEnd) {
+		return 0, false
+	}
+	return index, true
+}
+
+func pointerGet(doc interface{}, tokens []string) (interface{}, error) {
+	for i, token := range tokens {
+		switch container := doc.(type) {
+		case map[string]interface{}:
+			value, ok := container[token]
+			if !ok {
+				return nil, patchErrorf("path %s does not exist", formatPointer(tokens[:i+1]))
+			}
+			doc = value
+		case []interface{}:
+			index, ok := arrayIndex(token, len(container), false)
+			if !ok {
+				return nil, patchErrorf("path %s does not exist", formatPointer(tokens[:i+1]))
+			}
+			doc = container[index]
+		default:
+			return nil, patchErrorf("path %s does not exist", formatPointer(tokens[:i+1]))
+		}
+	}
+	return doc, nil
+}
+
+// pointerUpdate calls fn with the container holding the last token of tokens
+// and sets the container it returns back into doc.
+func pointerUpdate(doc interface{}, tokens []string, fn func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return fn(doc, tokens[0])
+	}
+
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		child, ok := container[tokens[0]]
+		if !ok {
+			return nil, patchErrorf("path /%s does not exist", tokens[0])
+		}
+		child, err := pointerUpdate(child, tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		container[tokens[0]] = child
+		return container, nil
+	case []interface{}:
+		index, ok := arrayIndex(tokens[0], len(container), false)
+		if !ok {
+			return nil, patchErrorf("path /%s does not exist", tokens[0])
+		}
+		child, err := pointerUpdate(container[index], tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		container[index] = child
+		return container, nil
+	default:
+		return nil, patchErrorf("path /%s does not exist", tokens[0])
+	}
+}
+
+func pointerAdd(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	return pointerUpdate(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			container[token] = value
+			return container, nil
+		case []interface{}:
+			index, ok := arrayIndex(token, len(container), true)
+			if !ok {
+				return nil, patchErrorf("array index %s is out of range", token)
+			}
+			container = append(container, nil)
+			copy(container[index+1:], container[index:])
+			container[index] = value
+			return container, nil
+		default:
+			return nil, patchErrorf("can not add %s to a value that is not an object or array", token)
+		}
+	})
+}
+
+func pointerRemove(doc interface{}, tokens []string) (interface{}, interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, nil, patchErrorf("can not remove the whole document")
+	}
+
+	var removed interface{}
+	doc, err := pointerUpdate(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			value, ok := container[token]
+			if !ok {
+				return nil, patchErrorf("path %s does not exist", formatPointer(tokens))
+			}
+			removed = value
+			delete(container, token)
+			return container, nil
+		case []interface{}:
+			index, ok := arrayIndex(token, len(container), false)
+			if !ok {
+				return nil, patchErrorf("path %s does not exist", formatPointer(tokens))
+			}
+			removed = container[index]
+			return append(container[:index], container[index+1:]...), nil
+		default:
+			return nil, patchErrorf("path %s does not exist", formatPointer(tokens))
+		}
+	})
+
+	return doc, removed, err
+}
+
+func pointerReplace(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	return pointerUpdate(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			container[token] = value
+			return container, nil
+		case []interface{}:
+			index, _ := arrayIndex(token, len(container), false)
+			container[index] = value
+			return container, nil
+		default:
+			return nil, patchErrorf("path %s does not exist", formatPointer(tokens))
+		}
+	})
+}
+
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			copied[key] = deepCopy(child)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, child := range v {
+			copied[i] = deepCopy(child)
+		}
+		return copied
+	default:
+		return v
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ValidationError is returned for recipe fields that are missing or not
+// valid. Message is meant for the client.
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (err *ValidationError) Error() string {
+	return err.Message
+}
+
+func notSet(field string) error {
+	return &ValidationError{field, fmt.Sprintf("%s is not set", field)}
+}
+
+func notValid(field string) error {
+	return &ValidationError{field, fmt.Sprintf("%s is not valid", field)}
+}
+
+// Limits of the app.recipes columns, name VARCHAR(128) and prep_time
+// SMALLINT.
+const (
+	maxRecipeNameLength = 128
+	maxPrepTime         = math.MaxInt16
+)
+
+// Validate checks the recipe fields on create, replace and update.
+func (fields RecipeFields) Validate() error {
+	if len(strings.TrimSpace(fields.Name)) == 0 {
+		return notSet("name")
+	}
+	if utf8.RuneCountInString(fields.Name) > maxRecipeNameLength {
+		return &ValidationError{"name", fmt.Sprintf("name is longer than %d characters", maxRecipeNameLength)}
+	}
+	if fields.PrepTime < 0 {
+		return notValid("prep_time")
+	}
+	if fields.PrepTime > maxPrepTime {
+		return &ValidationError{"prep_time", fmt.Sprintf("prep_time must be at most %d seconds", maxPrepTime)}
+	}
+	if fields.Difficulty < 1 || fields.Difficulty > 3 {
+		return notValid("difficulty")
+	}
+
+	return nil
+}
+
+// legacyFieldNames maps field names the API used to take to their current
+// name, they are still accepted on input.
+var legacyFieldNames = map[string]string{
+	"vegeterian": "vegetarian",
+}
+
+// recipeFieldName returns the current name of a possibly legacy field name.
+func recipeFieldName(name string) string {
+	if current, ok := legacyFieldNames[name]; ok {
+		return current
+	}
+	return name
+}
+
+// document returns the fields as a generic JSON document for patching, with
+// the same members as the API representation.
+func (fields RecipeFields) document() interface{} {
+	return map[string]interface{}{
+		"name":       fields.Name,
+		"prep_time":  float64(fields.PrepTime),
+		"difficulty": float64(fields.Difficulty),
+		"vegetarian": fields.Vegeterian,
+	}
+}
+
+// recipeFieldsFromForm reads every recipe field from the form values of r.
+func recipeFieldsFromForm(r *http.Request) (RecipeFields, error) {
+	return recipeFieldsFromValues(r.FormValue)
+}
+
+// recipeFieldsFromValues reads every recipe field from string values, as
+// given by a form or a CSV row.
+func recipeFieldsFromValues(value func(field string) string) (RecipeFields, error) {
+	fields := RecipeFields{Name: strings.TrimSpace(value("name"))}
+	if len(fields.Name) == 0 {
+		return fields, notSet("name")
+	}
+
+	prepTime, err := strconv.ParseInt(strings.TrimSpace(value("prep_time")), 10, 32)
+	if err != nil {
+		return fields, notValid("prep_time")
+	}
+	fields.PrepTime = int(prepTime)
+
+	difficulty, err := strconv.ParseInt(strings.TrimSpace(value("difficulty")), 10, 8)
+	if err != nil {
+		return fields, notValid("difficulty")
+	}
+	fields.Difficulty = int8(difficulty)
+
+	vegetarian := strings.TrimSpace(value("vegetarian"))
+	if len(vegetarian) == 0 {
+		vegetarian = strings.TrimSpace(value("vegeterian"))
+	}
+	fields.Vegeterian, err = strconv.ParseBool(vegetarian)
+	if err != nil {
+		return fields, notValid("vegetarian")
+	}
+
+	return fields, nil
+}
+
+// recipeFieldsFromDocument reads every recipe field from a JSON document,
+// rejecting unknown members. Legacy field names are accepted.
+func recipeFieldsFromDocument(doc interface{}) (RecipeFields, error) {
+	fields := RecipeFields{}
+	members, ok := doc.(map[string]interface{})
+	if !ok {
+		return fields, &ValidationError{"", "recipe must be a JSON object"}
+	}
+
+	obj := map[string]interface{}{}
+	for key, val := range members {
+		field := recipeFieldName(key)
+		switch field {
+		case "name", "prep_time", "difficulty", "vegetarian":
+		default:
+			return fields, &ValidationError{key, fmt.Sprintf("%s is not a recipe field", key)}
+		}
+		if _, ok := obj[field]; ok {
+			return fields, &ValidationError{field, fmt.Sprintf("%s is set more than once", field)}
+		}
+		obj[field] = val
+	}
+
+	integer := func(field string, bitSize int) (int64, error) {
+		val, ok := obj[field]
+		if !ok {
+			return 0, notSet(field)
+		}
+		f, ok := val.(float64)
+		limit := math.Exp2(float64(bitSize - 1))
+		if !ok || f != math.Trunc(f) || f < -limit || f >= limit {
+			return 0, notValid(field)
+		}
+		return int64(f), nil
+	}
+
+	val, ok := obj["name"]
+	if !ok {
+		return fields, notSet("name")
+	}
+	if fields.Name, ok = val.(string); !ok {
+		return fields, notValid("name")
+	}
+
+	prepTime, err := integer("prep_time", 32)
+	if err != nil {
+		return fields, err
+	}
+	fields.PrepTime = int(prepTime)
+
+	difficulty, err := integer("difficulty", 8)
+	if err != nil {
+		return fields, err
+	}
+	fields.Difficulty = int8(difficulty)
+
+	val, ok = obj["vegetarian"]
+	if !ok {
+		return fields, notSet("vegetarian")
+	}
+	if fields.Vegeterian, ok = val.(bool); !ok {
+		return fields, notValid("vegetarian")
+	}
+
+	return fields, nil
+}
+
+// recipeFieldsFromRequest reads and validates a full recipe from a JSON body
+// or from form values.
+func recipeFieldsFromRequest(r *http.Request) (RecipeFields, error) {
+	var fields RecipeFields
+	var err error
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		var doc interface{}
+		if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+			return fields, &ValidationError{"", "body is not valid JSON"}
+		}
+		fields, err = recipeFieldsFromDocument(doc)
+	} else {
+		fields, err = recipeFieldsFromForm(r)
+	}
+	if err != nil {
+		return fields, err
+	}
+
+	return fields, fields.Validate()
+}
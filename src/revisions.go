@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrRevisionNotFound = errors.New("revision not found")
+
+// RecipeFields are the recipe fields tracked by revisions.
+type RecipeFields struct {
+	Name       string `json:"name"`
+	PrepTime   int    `json:"prep_time"`
+	Difficulty int8   `json:"difficulty"`
+	Vegeterian bool   `json:"vegeterian"`
+}
+
+// RecipeUpdate holds the recipe fields to change, nil fields are kept.
+type RecipeUpdate struct {
+	Name       *string
+	PrepTime   *int
+	Difficulty *int8
+	Vegeterian *bool
+}
+
+// RecipeRevision records who changed a recipe, when, and its fields before
+// and after the change. Revisions are numbered from 1 per recipe.
+type RecipeRevision struct {
+	Revision  int
+	RecipeID  int64
+	UserID    int64
+	CreatedAt time.Time
+	Old       RecipeFields
+	New       RecipeFields
+}
+
+type FieldChange struct {
+	Field string
+	From  interface{}
+	To    interface{}
+}
+
+// RecipeChange computes the new fields of a recipe from its current ones.
+type RecipeChange func(fields RecipeFields) (RecipeFields, error)
+
+func (update RecipeUpdate) Apply(fields RecipeFields) RecipeFields {
+	if update.Name != nil {
+		fields.Name = *update.Name
+	}
+	if update.PrepTime != nil {
+		fields.PrepTime = *update.PrepTime
+	}
+	if update.Difficulty != nil {
+		fields.Difficulty = *update.Difficulty
+	}
+	if update.Vegeterian != nil {
+		fields.Vegeterian = *update.Vegeterian
+	}
+
+	return fields
+}
+
+// Change returns the update as a RecipeChange validating its result.
+func (update RecipeUpdate) Change() RecipeChange {
+	return func(fields RecipeFields) (RecipeFields, error) {
+		fields = update.Apply(fields)
+		return fields, fields.Validate()
+	}
+}
+
+// patchChange returns a RecipeChange applying patch to the recipe as a JSON
+// document and validating its result.
+func patchChange(patch DocumentPatch) RecipeChange {
+	patch = withRecipeFieldNames(patch)
+	return func(fields RecipeFields) (RecipeFields, error) {
+		doc, err := patch.Apply(fields.document())
+		if err != nil {
+			return fields, err
+		}
+
+		fields, err = recipeFieldsFromDocument(doc)
+		if err != nil {
+			return fields, err
+		}
+		return fields, fields.Validate()
+	}
+}
+
+// withRecipeFieldNames renames the legacy field names a patch uses, so that
+// it applies to the document of the fields.
+func withRecipeFieldNames(patch DocumentPatch) DocumentPatch {
+	rename := func(pointer []string) []string {
+		if len(pointer) == 0 {
+			return pointer
+		}
+		return append([]string{recipeFieldName(pointer[0])}, pointer[1:]...)
+	}
+
+	switch p := patch.(type) {
+	case MergePatch:
+		obj, ok := p.Patch.(map[string]interface{})
+		if !ok {
+			return p
+		}
+		renamed := map[string]interface{}{}
+		for key, val := range obj {
+			renamed[recipeFieldName(key)] = val
+		}
+		return MergePatch{renamed}
+	case JSONPatch:
+		renamed := JSONPatch{}
+		for _, op := range p {
+			op.Path = rename(op.Path)
+			op.From = rename(op.From)
+			renamed = append(renamed, op)
+		}
+		return renamed
+	}
+	return patch
+}
+
+// fullUpdate returns an update setting every field to the given values.
+func fullUpdate(fields RecipeFields) RecipeUpdate {
+	return RecipeUpdate{
+		Name:       &fields.Name,
+		PrepTime:   &fields.PrepTime,
+		Difficulty: &fields.Difficulty,
+		Vegeterian: &fields.Vegeterian,
+	}
+}
+
+// DiffRecipeFields lists the fields whose values differ between from and to.
+func DiffRecipeFields(from, to RecipeFields) []FieldChange {
+	changes := []FieldChange{}
+	if from.Name != to.Name {
+		changes = append(changes, FieldChange{"name", from.Name, to.Name})
+	}
+	if from.PrepTime != to.PrepTime {
+		changes = append(changes, FieldChange{"prep_time", from.PrepTime, to.PrepTime})
+	}
+	if from.Difficulty != to.Difficulty {
+		changes = append(changes, FieldChange{"difficulty", from.Difficulty, to.Difficulty})
+	}
+	if from.Vegeterian != to.Vegeterian {
+		changes = append(changes, FieldChange{"vegetarian", from.Vegeterian, to.Vegeterian})
+	}
+
+	return changes
+}
+
+// recipeStateAt returns the recipe fields right after the given revision.
+// Revision 0 is the recipe as it was created, before any revision.
+func recipeStateAt(revisions []RecipeRevision, revision int) (RecipeFields, error) {
+	if revision == 0 && len(revisions) > 0 {
+		return revisions[0].Old, nil
+	}
+
+	for _, rev := range revisions {
+		if rev.Revision == revision {
+			return rev.New, nil
+		}
+	}
+
+	return RecipeFields{}, ErrRevisionNotFound
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const v1Prefix = "/v1"
+
+// legacyRoutesDeprecated is when the unprefixed API routes were deprecated
+// in favor of /v1.
+var legacyRoutesDeprecated = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+
+// apiVersion registers the routes of one API version under its prefix and
+// documents them in the OpenAPI document. A new version gets its own
+// functions, so its handlers and response shapes can differ while older
+// versions keep being served.
+type apiVersion struct {
+	prefix   string
+	register func(router *mux.Router)
+	paths    func() map[string]OpenAPIPathItem
+}
+
+var apiVersions = []apiVersion{
+	{v1Prefix, registerV1Routes, v1Paths},
+}
+
+func registerV1Routes(router *mux.Router) {
+	router.HandleFunc("/register", RegisterHandler)
+	router.HandleFunc("/login", LoginHandler)
+	router.HandleFunc("/logout", LogoutHandler)
+	router.HandleFunc("/token/refresh", TokenRefreshHandler)
+	router.HandleFunc("/auth/oidc/login", OIDCLoginHandler)
+	router.HandleFunc("/auth/oidc/callback", OIDCCallbackHandler)
+	router.HandleFunc("/me/api-keys", APIKeysHandler)
+	router.HandleFunc("/me/api-keys/{id:[0-9]+}", APIKeyHandler)
+	router.HandleFunc("/me/sessions", SessionsHandler)
+	router.HandleFunc("/me/sessions/{id:[0-9a-f]+}", SessionHandler)
+	router.HandleFunc("/users/{id:[0-9]+}/sessions", UserSessionsHandler)
+
+	router.HandleFunc("/recipes", RecipesHandler)
+	router.HandleFunc("/recipes/import", ImportHandler)
+	router.HandleFunc("/recipes/export", ExportHandler)
+	router.HandleFunc("/recipes/{id}", RecipeHandler)
+	router.HandleFunc("/recipes/{id}/rate", RateHandler)
+	router.HandleFunc("/recipes/{id}/restore", RestoreHandler)
+	router.HandleFunc("/recipes/{id}/revisions", RevisionsHandler)
+	router.HandleFunc("/recipes/{id}/revisions/diff", RevisionsDiffHandler)
+	router.HandleFunc("/recipes/{id}/revisions/{revision:[0-9]+}/revert", RevertHandler)
+	router.HandleFunc("/trash", TrashHandler)
+	router.HandleFunc("/search", SearchHandler)
+}
+
+// newRouter returns the router of every API version. Operational endpoints
+// are not versioned. The unprefixed API routes are deprecated aliases of
+// /v1.
+func newRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.Use(loggingMiddleware, metricsMiddleware)
+
+	router.HandleFunc("/healthz", HealthzHandler)
+	router.HandleFunc("/readyz", ReadyzHandler)
+	router.HandleFunc("/version", VersionHandler)
+	router.Handle("/metrics", MetricsHandler())
+	router.HandleFunc("/openapi.json", OpenAPIHandler)
+
+	for _, version := range apiVersions {
+		version.register(router.PathPrefix(version.prefix).Subrouter())
+	}
+
+	legacy := router.NewRoute().Subrouter()
+	legacy.Use(deprecatedMiddleware(v1Prefix))
+	registerV1Routes(legacy)
+
+	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "This is the main page")
+	})
+
+	// Middlewares only run for matched routes, log and count 404s too
+	router.NotFoundHandler = loggingMiddleware(metricsMiddleware(http.NotFoundHandler()))
+
+	return router
+}
+
+// deprecatedMiddleware marks the responses of deprecated routes with the
+// Deprecation (RFC 9745) and Sunset (RFC 8594) headers, and links to the
+// same route under successorPrefix.
+func deprecatedMiddleware(successorPrefix string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", fmt.Sprintf("@%d", legacyRoutesDeprecated.Unix()))
+			if sunset, err := time.Parse(sunsetLayout, config.HTTP.LegacySunset); err == nil {
+				w.Header().Set("Sunset", sunset.Format(http.TimeFormat))
+			}
+			w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successorPrefix+r.URL.EscapedPath()))
+
+			loggerFrom(r.Context()).Debug("deprecated route called", "path", r.URL.Path, "successor", successorPrefix)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SchemaViolation is a part of a document not matching its JSON Schema.
+// Path is the JSON pointer of the offending value, empty for the document.
+type SchemaViolation struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// SchemaErrors lists every violation of a document.
+type SchemaErrors []SchemaViolation
+
+func (errs SchemaErrors) Error() string {
+	messages := []string{}
+	for _, violation := range errs {
+		messages = append(messages, fmt.Sprintf("%s: %s", violation.Path, violation.Message))
+	}
+	return strings.Join(messages, "; ")
+}
+
+// validateSchema checks a decoded JSON document against schema and returns
+// every violation found. Only the keywords our schemas use are supported:
+// type, enum, const, pattern, required, properties, additionalProperties
+// (false), items, minItems, allOf and if/then.
+func validateSchema(schema jsonSchema, doc interface{}) SchemaErrors {
+	return validateAt(schema, doc, []string{})
+}
+
+func validateAt(schema jsonSchema, value interface{}, path []string) SchemaErrors {
+	errs := SchemaErrors{}
+	violation := func(path []string, format string, args ...interface{}) {
+		errs = append(errs, SchemaViolation{formatPointer(path), fmt.Sprintf(format, args...)})
+	}
+
+	if expected, ok := schema["type"].(string); ok && !hasJSONType(value, expected) {
+		violation(path, "must be %s, not %s", withArticle(expected), withArticle(jsonTypeOf(value)))
+		// The other keywords would only repeat the type mismatch
+		return errs
+	}
+	if enum, ok := schema["enum"]; ok {
+		values := schemaValues(enum)
+		if !containsValue(values, value) {
+			violation(path, "must be one of %s", formatValues(values))
+		}
+	}
+	if expected, ok := schema["const"]; ok && !reflect.DeepEqual(expected, value) {
+		violation(path, "must be %s", formatValues([]interface{}{expected}))
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		if s, ok := value.(string); ok && !regexp.MustCompile(pattern).MatchString(s) {
+			violation(path, "must match %s", pattern)
+		}
+	}
+
+	if obj, ok := value.(map[string]interface{}); ok {
+		if required, ok := schema["required"].([]string); ok {
+			for _, name := range required {
+				if _, ok := obj[name]; !ok {
+					violation(path, "%s is required", name)
+				}
+			}
+		}
+
+		properties, _ := schema["properties"].(jsonSchema)
+		for _, name := range sortedKeys(obj) {
+			memberPath := append(append([]string{}, path...), name)
+			if property, ok := properties[name].(jsonSchema); ok {
+				errs = append(errs, validateAt(property, obj[name], memberPath)...)
+			} else if additional, ok := schema["additionalProperties"].(bool); ok && !additional {
+				violation(memberPath, "%s is not allowed", name)
+			}
+		}
+	}
+
+	if minItems, ok := schema["minItems"].(int); ok {
+		if array, ok := value.([]interface{}); ok && len(array) < minItems {
+			if minItems == 1 {
+				violation(path, "must not be empty")
+			} else {
+				violation(path, "must have at least %d items", minItems)
+			}
+		}
+	}
+	if items, ok := schema["items"].(jsonSchema); ok {
+		if array, ok := value.([]interface{}); ok {
+			for i, item := range array {
+				errs = append(errs, validateAt(items, item, append(append([]string{}, path...), strconv.Itoa(i)))...)
+			}
+		}
+	}
+
+	if allOf, ok := schema["allOf"].([]jsonSchema); ok {
+		for _, subschema := range allOf {
+			errs = append(errs, validateAt(subschema, value, path)...)
+		}
+	}
+	if condition, ok := schema["if"].(jsonSchema); ok {
+		if then, ok := schema["then"].(jsonSchema); ok && len(validateAt(condition, value, path)) == 0 {
+			errs = append(errs, validateAt(then, value, path)...)
+		}
+	}
+
+	return errs
+}
+
+func jsonTypeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == float64(int64(v)) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+// hasJSONType reports whether value is of the JSON Schema type expected,
+// integers being numbers too.
+func hasJSONType(value interface{}, expected string) bool {
+	actual := jsonTypeOf(value)
+	return actual == expected || (expected == "number" && actual == "integer")
+}
+
+func withArticle(jsonType string) string {
+	switch jsonType {
+	case "array", "object", "integer":
+		return "an " + jsonType
+	case "null":
+		return jsonType
+	}
+	return "a " + jsonType
+}
+
+// schemaValues returns the values of an enum, written as a []string or a
+// []interface{}.
+func schemaValues(enum interface{}) []interface{} {
+	switch v := enum.(type) {
+	case []string:
+		values := []interface{}{}
+		for _, s := range v {
+			values = append(values, s)
+		}
+		return values
+	case []interface{}:
+		return v
+	}
+	return nil
+}
+
+func containsValue(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if reflect.DeepEqual(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatValues(values []interface{}) string {
+	formatted := []string{}
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			formatted = append(formatted, strconv.Quote(s))
+			continue
+		}
+		b, _ := json.Marshal(v)
+		formatted = append(formatted, string(b))
+	}
+	return strings.Join(formatted, ", ")
+}
+
+func sortedKeys(obj map[string]interface{}) []string {
+	keys := []string{}
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
@@ -21,15 +23,102 @@ type Filter struct {
 	CaseSensitive bool   `json:"case_sensitive"`
 }
 
+// searchQuerySchema is the JSON Schema of SearchQuery, published in the
+// OpenAPI document and checked by ParseSearchQuery.
+var searchQuerySchema = jsonSchema{
+	"type":                 "object",
+	"required":             []string{"groups"},
+	"additionalProperties": false,
+	"properties": jsonSchema{
+		"groups": jsonSchema{
+			"description": "Groups are ORed, the filters of a group are ANDed.",
+			"type":        "array",
+			"minItems":    1,
+			"items": jsonSchema{
+				"type":                 "object",
+				"required":             []string{"filters"},
+				"additionalProperties": false,
+				"properties": jsonSchema{
+					"filters": jsonSchema{"type": "array", "minItems": 1, "items": filterSchema},
+				},
+			},
+		},
+	},
+}
+
+var filterSchema = jsonSchema{
+	"type":                 "object",
+	"required":             []string{"type", "value"},
+	"additionalProperties": false,
+	"properties": jsonSchema{
+		"type":           jsonSchema{"enum": []string{"name", "difficulty", "prep_time", "rate", "vegetarian", "vegeterian"}},
+		"operation":      jsonSchema{"type": "string"},
+		"value":          jsonSchema{"type": "string"},
+		"case_sensitive": jsonSchema{"type": "boolean"},
+	},
+	"allOf": []jsonSchema{
+		{
+			"if": jsonSchema{"required": []string{"type"}, "properties": jsonSchema{"type": jsonSchema{"const": "name"}}},
+			"then": jsonSchema{
+				"required":   []string{"operation"},
+				"properties": jsonSchema{"operation": jsonSchema{"enum": []string{"match", "=", "start", "end", "contain"}}},
+			},
+		},
+		{
+			"if": jsonSchema{"required": []string{"type"}, "properties": jsonSchema{"type": jsonSchema{"enum": []string{"difficulty", "prep_time", "rate"}}}},
+			"then": jsonSchema{
+				"required": []string{"operation"},
+				"properties": jsonSchema{
+					"operation": jsonSchema{"enum": []string{"=", "!=", ">", ">=", "<", "<="}},
+					// Up to 9 digits, so values always fit the int32 columns
+					"value": jsonSchema{"pattern": "^-?[0-9]{1,9}$"},
+				},
+			},
+		},
+		{
+			"if": jsonSchema{"required": []string{"type"}, "properties": jsonSchema{"type": jsonSchema{"enum": []string{"vegetarian", "vegeterian"}}}},
+			"then": jsonSchema{
+				"properties": jsonSchema{"value": jsonSchema{"enum": []string{"true", "false", "1", "0", "t", "f", "TRUE", "FALSE", "True", "False", "T", "F"}}},
+			},
+		},
+	},
+}
+
 var cols = map[string]string{
 	"name":       "name",
 	"difficulty": "difficulty",
 	"prep_time":  "prep_time",
 	"rate":       "rating",
+	"vegetarian": "vegeterian",
 	"vegeterian": "vegeterian",
 }
 
-func Search(searchQuery SearchQuery) ([]Recipe, error) {
+// ParseSearchQuery decodes a search query, validating it against
+// searchQuerySchema first. The returned error is a SchemaErrors listing
+// every violation.
+func ParseSearchQuery(query string) (SearchQuery, error) {
+	searchQuery := SearchQuery{}
+
+	var doc interface{}
+	if err := json.Unmarshal([]byte(query), &doc); err != nil {
+		return searchQuery, SchemaErrors{{"", fmt.Sprintf("query is not valid JSON: %s", err)}}
+	}
+	if errs := validateSchema(searchQuerySchema, doc); len(errs) != 0 {
+		return searchQuery, errs
+	}
+
+	// The schema already rejects unknown members, this guards against the
+	// schema and SearchQuery drifting apart
+	decoder := json.NewDecoder(strings.NewReader(query))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&searchQuery); err != nil {
+		return searchQuery, SchemaErrors{{"", err.Error()}}
+	}
+
+	return searchQuery, nil
+}
+
+func Search(ctx context.Context, searchQuery SearchQuery) ([]Recipe, error) {
 	results := []Recipe{}
 
 	parsedFilters, err := parseFilters(searchQuery)
@@ -37,7 +126,7 @@ func Search(searchQuery SearchQuery) ([]Recipe, error) {
 		return results, err
 	}
 
-	return db.GetRecipesByFilters(parsedFilters)
+	return db.GetRecipesByFilters(ctx, parsedFilters)
 }
 
 func parseFilters(query SearchQuery) (string, error) {
@@ -59,7 +148,7 @@ func parseFilters(query SearchQuery) (string, error) {
 					return "", err
 				}
 				conditions = append(conditions, condition)
-			case filter.Type == "vegeterian":
+			case filter.Type == "vegetarian" || filter.Type == "vegeterian":
 				condition, err := parseBoolFilter(filter)
 				if err != nil {
 					return "", err
@@ -82,7 +171,7 @@ func parseNumericFilter(filter Filter) (string, error) {
 		return condition, fmt.Errorf("filter operation '%s' for %s is not supported.", filter.Operation, filter.Type)
 	}
 
-	if _, err := strconv.ParseInt(filter.Value, 10, 8); err != nil {
+	if _, err := strconv.ParseInt(filter.Value, 10, 32); err != nil {
 		return condition, fmt.Errorf("filter value '%s' for %s is invalid.", filter.Value, filter.Type)
 	}
 	condition = fmt.Sprintf("a.%s %s %s", cols[filter.Type], filter.Operation, filter.Value)
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"io"
-	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"sync"
 	"time"
 
@@ -17,35 +19,123 @@ type Session struct {
 	SessionKey string
 	User       User
 	LoginTime  time.Time
+	// LastSeen is when the session was last read, it expires once it is not
+	// read for the session lifetime.
+	LastSeen time.Time
+	// UserAgent and IP are of the client that opened the session
+	UserAgent string
+	IP        string
+	// APIKeyID is the key a session authenticated with an API key was
+	// opened by, Scopes what the key is allowed to do.
+	APIKeyID int64
+	Scopes   []string
+	// FamilyID is the refresh token family of a JWT session, which has no
+	// session key.
+	FamilyID string
+}
+
+// ID identifies a session to its user without revealing its key, which
+// would let anyone reading it take the session over. JWT sessions are
+// identified by their refresh token family.
+func (session Session) ID() string {
+	if len(session.FamilyID) != 0 {
+		return session.FamilyID
+	}
+	return hashToken(session.SessionKey)[:32]
+}
+
+// isSameSession reports whether two sessions are the same cookie session or
+// JWT session.
+func isSameSession(session, other Session) bool {
+	if len(session.FamilyID) != 0 {
+		return session.FamilyID == other.FamilyID
+	}
+	return len(session.SessionKey) != 0 && session.SessionKey == other.SessionKey
+}
+
+// HasScope reports whether the session is allowed scope. Sessions without
+// scopes, e.g. cookie sessions, are allowed every scope.
+func (session Session) HasScope(scope string) bool {
+	if session.Scopes == nil {
+		return true
+	}
+	for _, s := range session.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
 }
 
 type SessionManager struct {
 	cookieName  string
-	lock        sync.Mutex
 	maxLifeTime int64
 	cleanUpTime int64
-	sessions    map[string]Session
+	store       SessionStore
+	cleanUpDone chan struct{}
+
+	// users caches the users of stores that do not refresh them, for
+	// userCacheTTL, so their sessions do not hit the db on every request
+	userCacheTTL time.Duration
+	usersLock    sync.Mutex
+	users        map[int64]cachedUser
 }
 
-func NewSessionManager(cookieName string, maxLifeTime, cleanUpTime int64) (*SessionManager, error) {
+// userCacheTTL is how long a user disabled or made admin, or no longer
+// admin, may keep a stale session in the memory and Redis stores.
+const userCacheTTL = 30 * time.Second
+
+// cachedUser is a user as read at fetchedAt, disabled when the user is
+// disabled or does not exist anymore.
+type cachedUser struct {
+	user      User
+	disabled  bool
+	fetchedAt time.Time
+}
+
+// NewSessionManager creates a session manager keeping sessions in store,
+// whose expired sessions clean up loop runs until ctx is cancelled.
+func NewSessionManager(ctx context.Context, store SessionStore, cookieName string, maxLifeTime, cleanUpTime int64) (*SessionManager, error) {
 	sessionManager := &SessionManager{
 		cookieName:  cookieName,
 		maxLifeTime: maxLifeTime,
 		cleanUpTime: cleanUpTime,
-		sessions:    make(map[string]Session),
+		store:       store,
+		cleanUpDone: make(chan struct{}),
+
+		userCacheTTL: userCacheTTL,
 	}
 
-	// Clean up expired sessions every 1 hour
+	// Clean up expired sessions every cleanUpTime seconds
 	go func() {
+		defer close(sessionManager.cleanUpDone)
+		ticker := time.NewTicker(time.Duration(sessionManager.cleanUpTime) * time.Second)
+		defer ticker.Stop()
+
 		for {
-			sessionManager.CleanupSessions(maxLifeTime)
-			time.Sleep(time.Duration(sessionManager.cleanUpTime) * time.Second)
+			sessionManager.CleanupSessions(ctx)
+			select {
+			case <-ctx.Done():
+				logger.Info("stop cleaning up session tokens")
+				return
+			case <-ticker.C:
+			}
 		}
 	}()
 
 	return sessionManager, nil
 }
 
+// Wait blocks until the clean up loop has stopped.
+func (sessionManager *SessionManager) Wait() {
+	<-sessionManager.cleanUpDone
+}
+
+// Close closes the session store, once the clean up loop has stopped.
+func (sessionManager *SessionManager) Close() error {
+	return sessionManager.store.Close()
+}
+
 func (sessionManager *SessionManager) sessionID() string {
 	b := make([]byte, 32)
 	if _, err := io.ReadFull(rand.Reader, b); err != nil {
@@ -54,92 +144,217 @@ func (sessionManager *SessionManager) sessionID() string {
 	return base64.URLEncoding.EncodeToString(b)
 }
 
+// SessionStart returns the session of the request when it is one of user,
+// and otherwise opens a new one replacing it, e.g. when another user logs
+// in on the same browser.
 func (sessionManager *SessionManager) SessionStart(w http.ResponseWriter, r *http.Request, user User) (Session, error) {
 	if sessionManager == nil {
-		log.Println("session manager is not initialized")
+		loggerFrom(r.Context()).Error("session manager is not initialized")
 		return Session{}, nil
 	}
 
-	sessionManager.lock.Lock()
-	defer sessionManager.lock.Unlock()
-
 	sid, err := sessionManager.getSessionID(r)
 	if err != nil || len(sid) == 0 {
 		return sessionManager.setCookie(w, r, user)
 	}
 
-	session, err := sessionManager.ReadSession(sid)
+	session, err := sessionManager.ReadSession(r.Context(), sid)
 	if err != nil || len(session.SessionKey) == 0 {
 		return sessionManager.setCookie(w, r, user)
 	}
+	if session.User.ID != user.ID {
+		if err := sessionManager.DestroySession(r.Context(), sid); err != nil {
+			return Session{}, err
+		}
+		return sessionManager.setCookie(w, r, user)
+	}
 
 	return session, nil
 }
 
-func (sessionManager *SessionManager) InitSession(sid string, userID int64) (Session, error) {
+// InitSession stores a new session of the user, with the client of the
+// login request r.
+func (sessionManager *SessionManager) InitSession(r *http.Request, sid string, user User) (Session, error) {
+	user.PasswordHash = ""
+	now := time.Now().UTC()
 	session := Session{
 		SessionKey: sid,
-		User: User{
-			ID: userID,
-		},
-		LoginTime: time.Now().UTC(),
+		User:       user,
+		LoginTime:  now,
+		LastSeen:   now,
+		UserAgent:  truncate(r.UserAgent(), 512),
+		IP:         clientIP(r),
 	}
 
-	err := db.InsertUserSession(session)
-	if err != nil {
+	return session, sessionManager.store.Create(r.Context(), session)
+}
+
+// ReadSession returns an unexpired session of an enabled user and extends
+// it by the session lifetime.
+func (sessionManager *SessionManager) ReadSession(ctx context.Context, sid string) (Session, error) {
+	session, err := sessionManager.store.Get(ctx, sid)
+	if err != nil || sessionManager.store.RefreshesUser() {
 		return session, err
 	}
 
-	sessionManager.sessions[session.SessionKey] = session
+	user, err := sessionManager.currentUser(ctx, session.User.ID)
+	if err == ErrUserDisabled {
+		if err := sessionManager.store.Delete(ctx, sid); err != nil {
+			return Session{}, err
+		}
+		return Session{}, ErrSessionNotFound
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	session.User = user
 
 	return session, nil
 }
 
-func (sessionManager *SessionManager) ReadSession(sid string) (Session, error) {
-	if session, ok := sessionManager.sessions[sid]; ok {
-		if session.LoginTime.Add(time.Duration(sessionManager.maxLifeTime) * time.Second).After(time.Now()) {
-			return session, nil
+// currentUser returns the user as it is in the db, or at most userCacheTTL
+// ago, and ErrUserDisabled for disabled and deleted users.
+func (sessionManager *SessionManager) currentUser(ctx context.Context, userID int64) (User, error) {
+	now := time.Now()
+	sessionManager.usersLock.Lock()
+	cached, ok := sessionManager.users[userID]
+	sessionManager.usersLock.Unlock()
+	if ok && now.Sub(cached.fetchedAt) < sessionManager.userCacheTTL {
+		if cached.disabled {
+			return User{}, ErrUserDisabled
+		}
+		return cached.user, nil
+	}
+
+	user, err := db.GetUserByID(ctx, userID)
+	if err != nil && err != ErrUserDisabled {
+		return user, err
+	}
+	if sessionManager.userCacheTTL > 0 {
+		sessionManager.usersLock.Lock()
+		if sessionManager.users == nil {
+			sessionManager.users = make(map[int64]cachedUser)
 		}
+		sessionManager.users[userID] = cachedUser{user, err == ErrUserDisabled, now}
+		sessionManager.usersLock.Unlock()
 	}
 
-	session, err := db.GetUserActiveSessions(sid, sessionManager.maxLifeTime)
+	return user, err
+}
+
+func (sessionManager *SessionManager) DestroySession(ctx context.Context, sid string) error {
+	return sessionManager.store.Delete(ctx, sid)
+}
+
+// UserSessions returns the unexpired sessions of a user, cookie sessions
+// and JWT sessions alike, most recently seen first.
+func (sessionManager *SessionManager) UserSessions(ctx context.Context, userID int64) ([]Session, error) {
+	sessions, err := sessionManager.store.UserSessions(ctx, userID)
 	if err != nil {
-		return session, err
+		return nil, err
+	}
+	families, err := db.GetRefreshTokenFamilies(ctx, userID, time.Now().UTC())
+	if err != nil {
+		return nil, err
 	}
 
-	return session, nil
+	sessions = append(sessions, families...)
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.After(sessions[j].LastSeen)
+	})
+	return sessions, nil
 }
 
-func (sessionManager *SessionManager) DestroySession(sid string) error {
-	sessionManager.lock.Lock()
-	defer sessionManager.lock.Unlock()
+// RevokeSession ends the session of the user with the given ID, revoking
+// the refresh tokens of a JWT session. It returns ErrSessionNotFound when
+// the user has no such session.
+func (sessionManager *SessionManager) RevokeSession(ctx context.Context, userID int64, id string) (Session, error) {
+	sessions, err := sessionManager.store.UserSessions(ctx, userID)
+	if err != nil {
+		return Session{}, err
+	}
+
+	for _, session := range sessions {
+		if session.ID() == id {
+			return session, sessionManager.store.Delete(ctx, session.SessionKey)
+		}
+	}
 
-	delete(sessionManager.sessions, sid)
-	return db.DeleteUserSessionByID(sid)
+	session := Session{User: User{ID: userID}, FamilyID: id}
+	return session, db.RevokeUserRefreshTokenFamily(ctx, userID, id, time.Now().UTC())
 }
 
-func (sessionManager *SessionManager) CleanupSessions(maxLifeTime int64) {
-	log.Println("Clean up expired session tokens")
-	t := time.Now().UTC().Add(-1 * time.Duration(maxLifeTime) * time.Second)
-	db.DeleteExpiredUserSessions(t)
+// RevokeUserSessions ends every session of the user: their cookie sessions
+// and the refresh tokens of their JWT sessions.
+func (sessionManager *SessionManager) RevokeUserSessions(ctx context.Context, userID int64) error {
+	if err := sessionManager.store.DeleteUser(ctx, userID); err != nil {
+		return err
+	}
+	return db.RevokeUserRefreshTokens(ctx, userID, time.Now().UTC())
 }
 
-func (sessionManager *SessionManager) setCookie(w http.ResponseWriter, r *http.Request, user User) (Session, error) {
-	sid := sessionManager.sessionID()
-	session, err := sessionManager.InitSession(sid, user.ID)
+// ActiveSessions returns the number of unexpired sessions in the session
+// store, or -1 when it can not be reached.
+func (sessionManager *SessionManager) ActiveSessions(ctx context.Context) int {
+	count, err := sessionManager.store.Count(ctx)
 	if err != nil {
-		return session, err
+		loggerFrom(ctx).Error("count sessions", "error", err)
+		return -1
+	}
+
+	return count
+}
+
+// Ping checks that the session store can be reached.
+func (sessionManager *SessionManager) Ping(ctx context.Context) error {
+	return sessionManager.store.Ping(ctx)
+}
+
+func (sessionManager *SessionManager) CleanupSessions(ctx context.Context) {
+	loggerFrom(ctx).Info("clean up expired session tokens")
+	if err := sessionManager.store.DeleteExpired(ctx); err != nil {
+		loggerFrom(ctx).Error("clean up expired sessions", "error", err)
+	}
+
+	sessionManager.usersLock.Lock()
+	for userID, cached := range sessionManager.users {
+		if time.Since(cached.fetchedAt) >= sessionManager.userCacheTTL {
+			delete(sessionManager.users, userID)
+		}
 	}
+	sessionManager.usersLock.Unlock()
+	db.DeleteExpiredRefreshTokens(ctx, time.Now().UTC())
+}
+
+// refreshCookie extends the cookie of a session read by a request, as
+// reading it extended the session.
+func (sessionManager *SessionManager) refreshCookie(w http.ResponseWriter, sid string) {
+	http.SetCookie(w, sessionManager.cookie(sid))
+}
+
+// clearCookie removes the session cookie of a session that ended.
+func (sessionManager *SessionManager) clearCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: sessionManager.cookieName, Path: "/", MaxAge: -1})
+}
 
-	cookie := http.Cookie{
+func (sessionManager *SessionManager) cookie(sid string) *http.Cookie {
+	return &http.Cookie{
 		Name:     sessionManager.cookieName,
 		Value:    url.QueryEscape(sid),
 		Path:     "/",
 		HttpOnly: true,
 		MaxAge:   int(sessionManager.maxLifeTime),
 	}
+}
+
+func (sessionManager *SessionManager) setCookie(w http.ResponseWriter, r *http.Request, user User) (Session, error) {
+	sid := sessionManager.sessionID()
+	session, err := sessionManager.InitSession(r, sid, user)
+	if err != nil {
+		return session, err
+	}
 
-	http.SetCookie(w, &cookie)
+	http.SetCookie(w, sessionManager.cookie(sid))
 	return session, nil
 }
 
@@ -153,6 +368,24 @@ func (sessionManager *SessionManager) getSessionID(r *http.Request) (string, err
 	return sid, nil
 }
 
+// clientIP is the address of the client of r. Addresses set by proxies in
+// headers are not used, clients could forge them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// truncate shortens s to at most n characters.
+func truncate(s string, n int) string {
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n])
+	}
+	return s
+}
+
 func (sessionManager *SessionManager) EncryptPassword(password string) (string, error) {
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
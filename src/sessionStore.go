@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrSessionNotFound = errors.New("session does not exist or expired")
+
+// SessionStore keeps cookie sessions. Sessions expire once they are not
+// read for the lifetime of the store, every read extending them. Stores are
+// safe for concurrent use.
+type SessionStore interface {
+	// Create stores a new session.
+	Create(ctx context.Context, session Session) error
+	// Get returns an unexpired session and extends it. It returns
+	// ErrSessionNotFound for unknown and expired sessions.
+	Get(ctx context.Context, sessionKey string) (Session, error)
+	// Delete removes a session, unknown sessions are ignored.
+	Delete(ctx context.Context, sessionKey string) error
+	// DeleteUser removes every session of a user.
+	DeleteUser(ctx context.Context, userID int64) error
+	// UserSessions returns the unexpired sessions of a user, most recently
+	// seen first.
+	UserSessions(ctx context.Context, userID int64) ([]Session, error)
+	// Count returns the number of unexpired sessions.
+	Count(ctx context.Context) (int, error)
+	// DeleteExpired removes expired sessions, for stores that do not expire
+	// them by themselves.
+	DeleteExpired(ctx context.Context) error
+	// RefreshesUser reports whether Get returns the user as it is now, not
+	// finding sessions of disabled users, rather than as it was at login.
+	RefreshesUser() bool
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// newSessionStore returns the store selected by the session config.
+func newSessionStore(cfg SessionConfig) (SessionStore, error) {
+	lifetime := time.Duration(cfg.CookieMaxAge) * time.Second
+	switch cfg.Store {
+	case sessionStoreMemory:
+		return NewMemorySessionStore(lifetime), nil
+	case sessionStoreSQL:
+		return NewSQLSessionStore(db, lifetime), nil
+	case sessionStoreRedis:
+		options, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			return nil, err
+		}
+		return NewRedisSessionStore(redis.NewClient(options), lifetime), nil
+	}
+	return nil, fmt.Errorf("unknown session store: %s", cfg.Store)
+}
+
+// MemorySessionStore keeps sessions in the process. They are lost on
+// restart and not shared by replicas.
+type MemorySessionStore struct {
+	lifetime time.Duration
+	lock     sync.Mutex
+	sessions map[string]Session
+}
+
+func NewMemorySessionStore(lifetime time.Duration) *MemorySessionStore {
+	return &MemorySessionStore{lifetime: lifetime, sessions: make(map[string]Session)}
+}
+
+func (store *MemorySessionStore) Create(ctx context.Context, session Session) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.sessions[session.SessionKey] = session
+	return nil
+}
+
+func (store *MemorySessionStore) Get(ctx context.Context, sessionKey string) (Session, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	session, ok := store.sessions[sessionKey]
+	if !ok || store.expired(session, time.Now()) {
+		return Session{}, ErrSessionNotFound
+	}
+	session.LastSeen = time.Now().UTC()
+	store.sessions[sessionKey] = session
+
+	return session, nil
+}
+
+func (store *MemorySessionStore) Delete(ctx context.Context, sessionKey string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	delete(store.sessions, sessionKey)
+	return nil
+}
+
+func (store *MemorySessionStore) DeleteUser(ctx context.Context, userID int64) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for sessionKey, session := range store.sessions {
+		if session.User.ID == userID {
+			delete(store.sessions, sessionKey)
+		}
+	}
+
+	return nil
+}
+
+func (store *MemorySessionStore) UserSessions(ctx context.Context, userID int64) ([]Session, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	now := time.Now()
+	sessions := []Session{}
+	for _, session := range store.sessions {
+		if session.User.ID == userID && !store.expired(session, now) {
+			sessions = append(sessions, session)
+		}
+	}
+	sortSessions(sessions)
+
+	return sessions, nil
+}
+
+func (store *MemorySessionStore) Count(ctx context.Context) (int, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	now := time.Now()
+	count := 0
+	for _, session := range store.sessions {
+		if !store.expired(session, now) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (store *MemorySessionStore) DeleteExpired(ctx context.Context) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	now := time.Now()
+	for sessionKey, session := range store.sessions {
+		if store.expired(session, now) {
+			delete(store.sessions, sessionKey)
+		}
+	}
+
+	return nil
+}
+
+func (store *MemorySessionStore) RefreshesUser() bool {
+	return false
+}
+
+func (store *MemorySessionStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (store *MemorySessionStore) Close() error {
+	return nil
+}
+
+func (store *MemorySessionStore) expired(session Session, now time.Time) bool {
+	return !session.LastSeen.Add(store.lifetime).After(now)
+}
+
+// SQLSessionStore keeps sessions in app.usersessions. Reading a session
+// also checks that its user is not disabled.
+type SQLSessionStore struct {
+	db       *DBManager
+	lifetime time.Duration
+}
+
+func NewSQLSessionStore(db *DBManager, lifetime time.Duration) *SQLSessionStore {
+	return &SQLSessionStore{db: db, lifetime: lifetime}
+}
+
+func (store *SQLSessionStore) Create(ctx context.Context, session Session) error {
+	return store.db.InsertUserSession(ctx, session)
+}
+
+func (store *SQLSessionStore) Get(ctx context.Context, sessionKey string) (Session, error) {
+	now := time.Now().UTC()
+	return store.db.TouchUserSession(ctx, sessionKey, now.Add(-store.lifetime), now)
+}
+
+func (store *SQLSessionStore) Delete(ctx context.Context, sessionKey string) error {
+	return store.db.DeleteUserSessionByID(ctx, sessionKey)
+}
+
+func (store *SQLSessionStore) DeleteUser(ctx context.Context, userID int64) error {
+	return store.db.DeleteUserSessionsByUserID(ctx, userID)
+}
+
+func (store *SQLSessionStore) UserSessions(ctx context.Context, userID int64) ([]Session, error) {
+	return store.db.GetUserSessions(ctx, userID, time.Now().UTC().Add(-store.lifetime))
+}
+
+func (store *SQLSessionStore) Count(ctx context.Context) (int, error) {
+	return store.db.CountUserSessions(ctx, time.Now().UTC().Add(-store.lifetime))
+}
+
+func (store *SQLSessionStore) DeleteExpired(ctx context.Context) error {
+	return store.db.DeleteExpiredUserSessions(ctx, time.Now().UTC().Add(-store.lifetime))
+}
+
+// RefreshesUser is true, Get reads the user along with the session.
+func (store *SQLSessionStore) RefreshesUser() bool {
+	return true
+}
+
+func (store *SQLSessionStore) Ping(ctx context.Context) error {
+	return store.db.Ping(ctx)
+}
+
+func (store *SQLSessionStore) Close() error {
+	return nil
+}
+
+// RedisSessionStore keeps sessions in Redis, or any server speaking its
+// protocol, as JSON under session:<key> expiring after the lifetime. The
+// keys of the sessions of each user are in the set user_sessions:<id>, and
+// every key is in the sorted set sessions scored by its expiry, to count
+// them without scanning the keyspace.
+type RedisSessionStore struct {
+	client   *redis.Client
+	lifetime time.Duration
+}
+
+const redisKeyPrefix = "recipe-api:"
+
+func NewRedisSessionStore(client *redis.Client, lifetime time.Duration) *RedisSessionStore {
+	return &RedisSessionStore{client: client, lifetime: lifetime}
+}
+
+func redisSessionKey(sessionKey string) string {
+	return redisKeyPrefix + "session:" + sessionKey
+}
+
+func redisUserSessionsKey(userID int64) string {
+	return redisKeyPrefix + "user_sessions:" + strconv.FormatInt(userID, 10)
+}
+
+const redisSessionsKey = redisKeyPrefix + "sessions"
+
+// expiry is the score in redisSessionsKey of a session seen at now, in
+// milliseconds.
+func (store *RedisSessionStore) expiry(now time.Time) float64 {
+	return float64(now.Add(store.lifetime).UnixMilli())
+}
+
+func (store *RedisSessionStore) Create(ctx context.Context, session Session) error {
+	b, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	userSessionsKey := redisUserSessionsKey(session.User.ID)
+	_, err = store.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, redisSessionKey(session.SessionKey), b, store.lifetime)
+		pipe.SAdd(ctx, userSessionsKey, session.SessionKey)
+		pipe.Expire(ctx, userSessionsKey, store.lifetime)
+		pipe.ZAdd(ctx, redisSessionsKey, redis.Z{Score: store.expiry(time.Now()), Member: session.SessionKey})
+		return nil
+	})
+	return err
+}
+
+func (store *RedisSessionStore) Get(ctx context.Context, sessionKey string) (Session, error) {
+	session, err := store.read(ctx, sessionKey)
+	if err != nil {
+		return session, err
+	}
+
+	session.LastSeen = time.Now().UTC()
+	b, err := json.Marshal(session)
+	if err != nil {
+		return session, err
+	}
+
+	// Only extend a session that was not deleted since it was read
+	var set *redis.BoolCmd
+	_, err = store.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		set = pipe.SetXX(ctx, redisSessionKey(sessionKey), b, store.lifetime)
+		pipe.Expire(ctx, redisUserSessionsKey(session.User.ID), store.lifetime)
+		pipe.ZAddXX(ctx, redisSessionsKey, redis.Z{Score: store.expiry(session.LastSeen), Member: sessionKey})
+		return nil
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	if !set.Val() {
+		return Session{}, ErrSessionNotFound
+	}
+
+	return session, nil
+}
+
+func (store *RedisSessionStore) read(ctx context.Context, sessionKey string) (Session, error) {
+	session := Session{}
+	b, err := store.client.Get(ctx, redisSessionKey(sessionKey)).Bytes()
+	if err == redis.Nil {
+		return session, ErrSessionNotFound
+	}
+	if err != nil {
+		return session, err
+	}
+
+	return session, json.Unmarshal(b, &session)
+}
+
+func (store *RedisSessionStore) Delete(ctx context.Context, sessionKey string) error {
+	session, err := store.read(ctx, sessionKey)
+	if err == ErrSessionNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = store.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, redisSessionKey(sessionKey))
+		pipe.SRem(ctx, redisUserSessionsKey(session.User.ID), sessionKey)
+		pipe.ZRem(ctx, redisSessionsKey, sessionKey)
+		return nil
+	})
+	return err
+}
+
+func (store *RedisSessionStore) DeleteUser(ctx context.Context, userID int64) error {
+	userSessionsKey := redisUserSessionsKey(userID)
+	sessionKeys, err := store.client.SMembers(ctx, userSessionsKey).Result()
+	if err != nil {
+		return err
+	}
+
+	keys := []string{userSessionsKey}
+	members := []interface{}{}
+	for _, sessionKey := range sessionKeys {
+		keys = append(keys, redisSessionKey(sessionKey))
+		members = append(members, sessionKey)
+	}
+	_, err = store.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, keys...)
+		if len(members) != 0 {
+			pipe.ZRem(ctx, redisSessionsKey, members...)
+		}
+		return nil
+	})
+	return err
+}
+
+// UserSessions also removes the keys of expired sessions from the set of
+// the user.
+func (store *RedisSessionStore) UserSessions(ctx context.Context, userID int64) ([]Session, error) {
+	userSessionsKey := redisUserSessionsKey(userID)
+	sessionKeys, err := store.client.SMembers(ctx, userSessionsKey).Result()
+	if err != nil || len(sessionKeys) == 0 {
+		return []Session{}, err
+	}
+
+	keys := []string{}
+	for _, sessionKey := range sessionKeys {
+		keys = append(keys, redisSessionKey(sessionKey))
+	}
+	values, err := store.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []Session{}
+	expired := []interface{}{}
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			expired = append(expired, sessionKeys[i])
+			continue
+		}
+
+		session := Session{}
+		if err := json.Unmarshal([]byte(s), &session); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	if len(expired) != 0 {
+		_, err := store.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SRem(ctx, userSessionsKey, expired...)
+			pipe.ZRem(ctx, redisSessionsKey, expired...)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sortSessions(sessions)
+
+	return sessions, nil
+}
+
+// Count counts the sessions whose expiry is still ahead.
+func (store *RedisSessionStore) Count(ctx context.Context) (int, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	count, err := store.client.ZCount(ctx, redisSessionsKey, "("+now, "+inf").Result()
+	return int(count), err
+}
+
+// DeleteExpired removes the expired sessions from the sorted set of every
+// session, Redis expires the sessions themselves.
+func (store *RedisSessionStore) DeleteExpired(ctx context.Context) error {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	return store.client.ZRemRangeByScore(ctx, redisSessionsKey, "-inf", now).Err()
+}
+
+func (store *RedisSessionStore) RefreshesUser() bool {
+	return false
+}
+
+func (store *RedisSessionStore) Ping(ctx context.Context) error {
+	return store.client.Ping(ctx).Err()
+}
+
+func (store *RedisSessionStore) Close() error {
+	return store.client.Close()
+}
+
+// sortSessions sorts sessions the most recently seen first.
+func sortSessions(sessions []Session) {
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.After(sessions[j].LastSeen)
+	})
+}
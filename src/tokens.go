@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// refreshTokenPrefix starts every refresh token, telling them apart from
+// API keys.
+const refreshTokenPrefix = "rt_"
+
+// accessTokenIssuer is the iss claim of access tokens.
+const accessTokenIssuer = "recipe-api"
+
+var (
+	ErrRefreshTokenNotValid = errors.New("refresh token is not valid")
+	ErrRefreshTokenReused   = errors.New("refresh token was already used, its family is revoked")
+)
+
+// RefreshToken is a server-side refresh token of a JWT session. Every
+// token issued by refreshing the previous one shares its FamilyID, and the
+// UserAgent and IP of the client that opened the session.
+type RefreshToken struct {
+	UserID    int64
+	FamilyID  string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UserAgent string
+	IP        string
+}
+
+// accessClaims are the claims of an access token. The subject is the user
+// ID, so requests are authorized without reading the session store, and
+// the sid is the refresh token family of the session.
+type accessClaims struct {
+	Username  string `json:"preferred_username"`
+	Fullname  string `json:"name,omitempty"`
+	IsAdmin   bool   `json:"admin,omitempty"`
+	SessionID string `json:"sid,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Tokens are the tokens of a JWT session, as returned by /login and
+// /token/refresh.
+type Tokens struct {
+	AccessToken  string
+	ExpiresIn    int64
+	RefreshToken string
+}
+
+// newAccessToken signs an access token of the user with the configured
+// signing key, whose kid is set in the header.
+func newAccessToken(user User, familyID string, now time.Time) (string, error) {
+	kid := config.Session.JWTSigningKey
+	key, ok := config.Session.JWTKeys[kid]
+	if !ok {
+		return "", fmt.Errorf("jwt signing key %s is not configured", kid)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims{
+		Username:  user.Username,
+		Fullname:  user.Fullname,
+		IsAdmin:   user.IsAdmin,
+		SessionID: familyID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    accessTokenIssuer,
+			Subject:   strconv.FormatInt(user.ID, 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Duration(config.Session.AccessTokenTTL) * time.Second)),
+		},
+	})
+	token.Header["kid"] = kid
+
+	return token.SignedString([]byte(key))
+}
+
+// authAccessToken verifies an access token with the key named by its kid
+// and returns the session it was issued for.
+func authAccessToken(token string) (Session, error) {
+	claims := accessClaims{}
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, ok := config.Session.JWTKeys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown kid: %s", kid)
+		}
+		return []byte(key), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithIssuer(accessTokenIssuer), jwt.WithExpirationRequired())
+	if err != nil {
+		return Session{}, err
+	}
+
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return Session{}, fmt.Errorf("access token subject is not a user ID: %s", claims.Subject)
+	}
+
+	session := Session{User: User{ID: userID, Username: claims.Username, Fullname: claims.Fullname, IsAdmin: claims.IsAdmin}, FamilyID: claims.SessionID}
+	if claims.IssuedAt != nil {
+		session.LoginTime = claims.IssuedAt.Time
+	}
+	return session, nil
+}
+
+// IssueTokens opens a JWT session of the user, logging in with r, with a
+// new refresh token family.
+func IssueTokens(r *http.Request, user User) (Tokens, error) {
+	familyID, err := randomHex(16)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	refreshToken, hash, err := newToken(refreshTokenPrefix)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	now := time.Now().UTC()
+	token := newRefreshToken(user.ID, familyID, now)
+	token.UserAgent = truncate(r.UserAgent(), 512)
+	token.IP = clientIP(r)
+	if err := db.InsertRefreshToken(r.Context(), token, hash); err != nil {
+		return Tokens{}, err
+	}
+
+	return withAccessToken(user, familyID, refreshToken, now)
+}
+
+// RefreshTokens exchanges a refresh token for a new access token and the
+// next refresh token of its family.
+func RefreshTokens(ctx context.Context, refreshToken string) (Tokens, error) {
+	next, hash, err := newToken(refreshTokenPrefix)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	now := time.Now().UTC()
+	user, familyID, err := db.RotateRefreshToken(ctx, hashToken(refreshToken), newRefreshToken(0, "", now), hash)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	return withAccessToken(user, familyID, next, now)
+}
+
+// RevokeTokens ends the JWT session of a refresh token. Its access tokens
+// stay valid until they expire.
+func RevokeTokens(ctx context.Context, refreshToken string) error {
+	return db.RevokeRefreshTokenFamily(ctx, hashToken(refreshToken), time.Now().UTC())
+}
+
+func newRefreshToken(userID int64, familyID string, now time.Time) RefreshToken {
+	return RefreshToken{
+		UserID:    userID,
+		FamilyID:  familyID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Duration(config.Session.RefreshTokenTTL) * time.Second),
+	}
+}
+
+func withAccessToken(user User, familyID string, refreshToken string, now time.Time) (Tokens, error) {
+	accessToken, err := newAccessToken(user, familyID, now)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	return Tokens{AccessToken: accessToken, ExpiresIn: config.Session.AccessTokenTTL, RefreshToken: refreshToken}, nil
+}
+
+// refreshTokenFromRequest reads refresh_token from a JSON object or form
+// values.
+func refreshTokenFromRequest(r *http.Request) (string, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		var body struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return "", &ValidationError{"", "body is not valid JSON"}
+		}
+		return body.RefreshToken, nil
+	}
+
+	return r.FormValue("refresh_token"), nil
+}
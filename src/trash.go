@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// TrashPurger permanently deletes recipes that have been in the trash for
+// longer than the retention period.
+type TrashPurger struct {
+	retention time.Duration
+	interval  time.Duration
+	done      chan struct{}
+}
+
+// NewTrashPurger starts purging the trash every interval until ctx is
+// cancelled.
+func NewTrashPurger(ctx context.Context, retention, interval time.Duration) *TrashPurger {
+	trashPurger := &TrashPurger{
+		retention: retention,
+		interval:  interval,
+		done:      make(chan struct{}),
+	}
+
+	go func() {
+		defer close(trashPurger.done)
+		ticker := time.NewTicker(trashPurger.interval)
+		defer ticker.Stop()
+
+		for {
+			trashPurger.Purge(ctx)
+			select {
+			case <-ctx.Done():
+				logger.Info("stop purging the trash")
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return trashPurger
+}
+
+// Wait blocks until the purge loop has stopped.
+func (trashPurger *TrashPurger) Wait() {
+	<-trashPurger.done
+}
+
+func (trashPurger *TrashPurger) Purge(ctx context.Context) {
+	n, err := db.PurgeDeletedRecipes(ctx, time.Now().UTC().Add(-trashPurger.retention))
+	if err != nil {
+		logger.Error("could not purge deleted recipes", "error", err)
+		return
+	}
+	if n > 0 {
+		logger.Info("purged deleted recipes", "count", n)
+	}
+}